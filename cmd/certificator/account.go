@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/acme"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// rolloverKey replaces ACME account key with a newly generated one
+func rolloverKey(args []string, cas *caClients, vaultClient *vault.VaultClient, logger *logrus.Logger) {
+	acmeClient := accountClient("rollover-key", args, cas, logger)
+
+	logger.Info("rolling over ACME account key")
+	if err := acmeClient.RolloverKey(vaultClient); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("ACME account key rolled over")
+}
+
+// deactivateAccount deactivates ACME account and removes it from Vault
+func deactivateAccount(args []string, cas *caClients, vaultClient *vault.VaultClient, logger *logrus.Logger) {
+	acmeClient := accountClient("deactivate-account", args, cas, logger)
+
+	logger.Info("deactivating ACME account")
+	if err := acmeClient.Deactivate(vaultClient); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("ACME account deactivated")
+}
+
+// accountClient returns client of CA profile selected with -ca flag of account command
+func accountClient(command string, args []string, cas *caClients, logger *logrus.Logger) *acme.Client {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	caName := flags.String("ca", "", "name of CA profile whose account is used, the primary (first) profile if not set")
+	_ = flags.Parse(args)
+
+	profile, err := cas.named(*caName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	acmeClient, err := cas.client(profile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return acmeClient
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/acme"
+	"github.com/vinted/certificator/pkg/config"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// caClients creates ACME clients of configured CA profiles on first use,
+// so that an unreachable CA does not prevent using the other ones
+type caClients struct {
+	profiles []config.CA
+	failover bool
+	clients  map[string]*acme.Client
+	errs     map[string]error
+	vault    *vault.VaultClient
+	logger   *logrus.Logger
+}
+
+func newCAClients(cfg config.Config, vaultClient *vault.VaultClient, logger *logrus.Logger) *caClients {
+	return &caClients{
+		profiles: cfg.CAProfiles(),
+		failover: cfg.Acme.CAFailover,
+		clients:  make(map[string]*acme.Client),
+		errs:     make(map[string]error),
+		vault:    vaultClient,
+		logger:   logger,
+	}
+}
+
+// client returns client of CA profile, creating it and registering ACME account if needed
+func (c *caClients) client(profile config.CA) (*acme.Client, error) {
+	if client, ok := c.clients[profile.Name]; ok {
+		return client, nil
+	}
+	if err, ok := c.errs[profile.Name]; ok {
+		return nil, err
+	}
+
+	eab := acme.ExternalAccountBinding{KeyID: profile.EABKeyID, HMACKey: profile.EABHMACKey}
+	client, err := acme.NewClient(profile.AccountEmail, profile.ServerURL, eab, *profile.ReregisterAccount,
+		c.vault, c.logger)
+	if err != nil {
+		err = fmt.Errorf("setting up client of CA %s: %w", profile.Name, err)
+		c.errs[profile.Name] = err
+		return nil, err
+	}
+	c.clients[profile.Name] = client
+
+	return client, nil
+}
+
+// named returns CA profile with the given name, the primary (first) profile is returned for empty name
+func (c *caClients) named(name string) (config.CA, error) {
+	if name == "" {
+		return c.profiles[0], nil
+	}
+	for _, profile := range c.profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+
+	return config.CA{}, fmt.Errorf("unknown CA profile %s", name)
+}
+
+// byURL returns CA profile with the given ACME directory URL.
+// Primary profile is returned for empty URL, as certificates stored before CA was recorded
+// were issued by it. False is returned if no profile has the URL
+func (c *caClients) byURL(serverURL string) (config.CA, bool) {
+	if serverURL == "" {
+		return c.profiles[0], true
+	}
+	for _, profile := range c.profiles {
+		if strings.TrimSuffix(profile.ServerURL, "/") == strings.TrimSuffix(serverURL, "/") {
+			return profile, true
+		}
+	}
+
+	return config.CA{}, false
+}
+
+// order returns CA profiles in the order they are tried: the preferred one first,
+// followed by the other profiles in configuration order if failover is enabled
+func (c *caClients) order(preferred string) []config.CA {
+	first, err := c.named(preferred)
+	if err != nil {
+		first = c.profiles[0]
+	}
+
+	order := []config.CA{first}
+	if !c.failover {
+		return order
+	}
+	for _, profile := range c.profiles {
+		if profile.Name != first.Name {
+			order = append(order, profile)
+		}
+	}
+
+	return order
+}
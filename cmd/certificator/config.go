@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/config"
+)
+
+// settings are configuration options given with -set flags, keyed by environment variable names
+type settings map[string]string
+
+func (s settings) String() string {
+	pairs := make([]string, 0, len(s))
+	for name, value := range s {
+		pairs = append(pairs, name+"="+value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (s settings) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("setting %q is not in NAME=VALUE format", value)
+	}
+	s[parts[0]] = parts[1]
+
+	return nil
+}
+
+// apply sets settings as environment variables, so that they override config file and environment
+func (s settings) apply() error {
+	for name, value := range s {
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printConfig prints effective configuration with secrets redacted
+func printConfig(cfg config.Config, logger *logrus.Logger) {
+	out, err := cfg.Redacted()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	fmt.Print(string(out))
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
-	"strings"
+	"flag"
+	"fmt"
+	"os"
+	"time"
 
 	legoLog "github.com/go-acme/lego/v4/log"
 	"github.com/sirupsen/logrus"
@@ -15,7 +18,23 @@ func main() {
 	logger := logrus.New()
 	legoLog.Logger = logger
 
-	cfg, err := config.LoadConfig()
+	overrides := settings{}
+	configFile := flag.String("config", "", "path to YAML config file, CERTIFICATOR_CONFIG_FILE is used if not set")
+	flag.Var(overrides, "set", "set configuration option, overriding config file and environment, "+
+		"e.g. -set LOG_LEVEL=DEBUG. Can be repeated")
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := overrides.apply(); err != nil {
+		logger.Fatal(err)
+	}
+
+	// Domains file can be validated without credentials
+	loadConfig := config.LoadConfig
+	if flag.Arg(0) == "validate" {
+		loadConfig = config.LoadDomainsConfig
+	}
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -40,49 +59,125 @@ func main() {
 		logger.SetLevel(logrus.FatalLevel)
 	}
 
-	vaultClient, err := vault.NewVaultClient(cfg.Vault.ApproleRoleID,
-		cfg.Vault.ApproleSecretID, cfg.Environment, cfg.Vault.KVStoragePath, logger)
-	if err != nil {
-		logger.Fatal(err)
+	// These commands do not need access to Vault or CA, so that they can be run anywhere
+	switch flag.Arg(0) {
+	case "validate":
+		validate(cfg, logger)
+		return
+	case "print-config":
+		printConfig(cfg, logger)
+		return
 	}
 
-	acmeClient, err := acme.NewClient(cfg.Acme.AccountEmail, cfg.Acme.ServerURL,
-		cfg.Acme.ReregisterAccount, vaultClient, logger)
+	vaultClient, err := vault.NewVaultClientWithAuth(cfg.VaultAuth(), cfg.Vault.KVStoragePath, logger)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	defer vaultClient.Close()
+
+	cas := newCAClients(cfg, vaultClient, logger)
+
+	switch command := flag.Arg(0); command {
+	case "", "renew":
+		renew(cfg, cas, vaultClient, logger)
+	case "revoke":
+		revoke(flag.Args()[1:], cfg, cas, vaultClient, logger)
+	case "rollback":
+		rollback(flag.Args()[1:], cfg, vaultClient, logger)
+	case "rollover-key":
+		rolloverKey(flag.Args()[1:], cas, vaultClient, logger)
+	case "deactivate-account":
+		deactivateAccount(flag.Args()[1:], cas, vaultClient, logger)
+	case "migrate-vault-paths":
+		migrateVaultPaths(flag.Args()[1:], cfg, vaultClient, logger)
+	default:
+		logger.Errorf("unknown command %q", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [command]
 
+Commands:
+  renew                obtain missing and renew expiring certificates (default)
+  revoke               revoke a certificate stored in Vault
+  rollback             restore previous version of a certificate stored in Vault
+  rollover-key         replace ACME account key with a newly generated one
+  deactivate-account   deactivate ACME account and remove it from Vault
+  migrate-vault-paths  move certificates to locations of CERTIFICATOR_VAULT_PATH_TEMPLATE
+  validate             check domains file for problems, exits with non-zero status if any are found
+  print-config         print effective configuration with secrets redacted
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// renew obtains certificates for all domains that need reissuing
+func renew(cfg config.Config, cas *caClients, vaultClient *vault.VaultClient, logger *logrus.Logger) {
 	var failedDomains []string
 
 	for _, dom := range cfg.Domains {
-		allDomains := strings.Split(dom, ",")
-		mainDomain := allDomains[0]
-		cert, err := certificate.GetCertificate(mainDomain, vaultClient)
+		entryLogger := logger.WithField("domains_file", dom.Source)
+
+		request, err := certificateRequest(cfg, dom)
 		if err != nil {
-			failedDomains = append(failedDomains, mainDomain)
-			logger.Error(err)
+			failedDomains = append(failedDomains, dom.Name)
+			entryLogger.Error(err)
 			continue
 		}
-		logger.Infof("checking certificate for %s", mainDomain)
 
-		needsReissuing, err := certificate.NeedsReissuing(cert, allDomains, cfg.RenewBeforeDays, logger)
+		stored, err := certificate.ReadCertificate(request.VaultPath, vaultClient)
 		if err != nil {
-			failedDomains = append(failedDomains, mainDomain)
-			logger.Error(err)
+			failedDomains = append(failedDomains, dom.Name)
+			entryLogger.Error(err)
 			continue
 		}
+		entryLogger.Infof("checking certificate for %s", dom.Name)
+		cert, caURL := stored.Certificate, stored.CAURL
+		// Certificate is not stored if another run changes it meanwhile
+		request.VaultVersion = &stored.Version
+
+		// Renewal information is advisory, fall back to expiration date if issuing CA cannot provide it
+		var renewalInfo *acme.RenewalInfo
+		issuer, known := cas.byURL(caURL)
+		if !known {
+			entryLogger.Warnf("certificate for %s was issued by CA %s, which is not configured", dom.Name, caURL)
+		} else if issuerClient, err := cas.client(issuer); err != nil {
+			entryLogger.Warn(err)
+		} else if renewalInfo, err = issuerClient.GetRenewalInfo(cert); err != nil {
+			entryLogger.Warn(err)
+		}
+
+		renewBeforeDays := cfg.RenewBeforeDays
+		if dom.RenewBeforeDays != 0 {
+			renewBeforeDays = dom.RenewBeforeDays
+		}
+
+		needsReissuing, err := certificate.NeedsReissuing(cert, request.Domains, request.KeyType, renewalInfo,
+			renewBeforeDays, logger)
+		if err != nil {
+			failedDomains = append(failedDomains, dom.Name)
+			entryLogger.Error(err)
+			continue
+		}
+
+		var replaces string
+		if renewalInfo != nil {
+			replaces = renewalInfo.CertID
+		}
 
 		if needsReissuing {
-			logger.Infof("obtaining certificate for %s", mainDomain)
-			err := certificate.ObtainCertificate(acmeClient, vaultClient, allDomains,
-				cfg.DNSAddress, cfg.Acme.DNSChallengeProvider, cfg.Acme.DNSPropagationRequirement)
-			if err != nil {
-				failedDomains = append(failedDomains, mainDomain)
-				logger.Error(err)
+			entryLogger.Infof("obtaining certificate for %s", dom.Name)
+			if err := obtain(cas, vaultClient, request, dom.CA, issuer, replaces, entryLogger); err != nil {
+				failedDomains = append(failedDomains, dom.Name)
+				entryLogger.Error(err)
 				continue
 			}
 		} else {
-			logger.Infof("certificate for %s is up to date, skipping renewal", mainDomain)
+			entryLogger.Infof("certificate for %s is up to date, skipping renewal", dom.Name)
 		}
 	}
 
@@ -90,3 +185,143 @@ func main() {
 		logger.Fatalf("Failed to renew certificates for: %v", failedDomains)
 	}
 }
+
+// obtain obtains certificate from the preferred CA, or the primary one if none is preferred.
+// If CA is rate limiting, failing or unreachable, other CAs are tried in turn when failover is enabled.
+// Replaced certificate is referenced only in orders to CA that issued it
+func obtain(cas *caClients, vaultClient *vault.VaultClient, request certificate.Request, preferred string,
+	issuer config.CA, replaces string, logger *logrus.Entry) error {
+	var err error
+	for _, profile := range cas.order(preferred) {
+		client, clientErr := cas.client(profile)
+		if clientErr != nil {
+			err = clientErr
+			logger.Warn(err)
+			continue
+		}
+
+		request.Replaces = ""
+		if profile.Name == issuer.Name {
+			request.Replaces = replaces
+		}
+
+		err = certificate.ObtainCertificate(client, vaultClient, request, logger)
+		if err == nil {
+			logger.Infof("certificate for %s obtained from CA %s", request.Domains[0], profile.Name)
+			return nil
+		}
+		if !acme.ShouldFailover(err) {
+			return err
+		}
+		logger.Warnf("CA %s cannot issue certificate for %s: %v", profile.Name, request.Domains[0], err)
+	}
+
+	return err
+}
+
+// certificateRequest builds certificate request of domains entry,
+// options set in the entry override global configuration
+func certificateRequest(cfg config.Config, dom config.Domain) (certificate.Request, error) {
+	keyTypeName := cfg.KeyType
+	if dom.KeyType != "" {
+		keyTypeName = dom.KeyType
+	}
+	keyType, err := certificate.ParseKeyType(keyTypeName)
+	if err != nil {
+		return certificate.Request{}, err
+	}
+
+	location, err := cfg.CertificateLocation(dom)
+	if err != nil {
+		return certificate.Request{}, err
+	}
+
+	request := certificate.Request{
+		Domains:              dom.AllDomains(),
+		VaultPath:            location,
+		KeyType:              keyType,
+		PreferredChain:       cfg.Acme.PreferredChain,
+		StoreAlternateChains: cfg.Acme.StoreAlternateChains,
+		Challenge: certificate.Challenge{
+			Type:         cfg.Acme.ChallengeType,
+			DNSAddresses: cfg.DNSAddresses,
+			DNSProvider: certificate.DNSProvider{
+				Provider:  cfg.Acme.DNSChallengeProvider,
+				VaultPath: cfg.Acme.DNSCredentialsVaultPath,
+			},
+			DNSProviders:              dnsProviders(cfg.DNSProviders),
+			DNSPropagationRequirement: cfg.Acme.DNSPropagationRequirement,
+			DNSAuthoritativeCheck:     cfg.Acme.DNSAuthoritativeCheck,
+			DNSTiming:                 dnsTiming(cfg.Acme.DNSTTL, cfg.Acme.DNSPropagationTimeout, cfg.Acme.DNSPollingInterval),
+			HTTPAddress:               cfg.Acme.HTTP01Address,
+			HTTPWebroot:               cfg.Acme.HTTP01Webroot,
+			TLSALPNAddress:            cfg.Acme.TLSALPN01Address,
+		},
+	}
+
+	if dom.PreferredChain != "" {
+		request.PreferredChain = dom.PreferredChain
+	}
+	if dom.StoreAlternateChains != nil {
+		request.StoreAlternateChains = *dom.StoreAlternateChains
+	}
+	if dom.Challenge != "" {
+		request.Challenge.Type = dom.Challenge
+	}
+	if dom.DNSProvider != "" {
+		request.Challenge.DNSProvider = namedDNSProvider(cfg.DNSProviders, dom.DNSProvider)
+		request.Challenge.DNSProviders = nil
+	}
+	if dom.HTTP01Webroot != "" {
+		request.Challenge.HTTPWebroot = dom.HTTP01Webroot
+	}
+	if dom.TLSALPN01Address != "" {
+		request.Challenge.TLSALPNAddress = dom.TLSALPN01Address
+	}
+
+	return request, nil
+}
+
+// dnsProviders converts DNS providers defined in domains file to certificate DNS providers
+func dnsProviders(providers []config.DNSProvider) []certificate.DNSProvider {
+	var result []certificate.DNSProvider
+	for _, provider := range providers {
+		if len(provider.Zones) > 0 {
+			result = append(result, certificate.DNSProvider{
+				Provider:  provider.Provider,
+				Zones:     provider.Zones,
+				Settings:  provider.Settings,
+				VaultPath: provider.VaultPath,
+				Timing:    dnsTiming(provider.TTL, provider.PropagationTimeout, provider.PollingInterval),
+			})
+		}
+	}
+
+	return result
+}
+
+// namedDNSProvider returns DNS provider defined in domains file with the given name,
+// name is treated as lego DNS challenge provider name if there is no such provider
+func namedDNSProvider(providers []config.DNSProvider, name string) certificate.DNSProvider {
+	for _, provider := range providers {
+		if provider.Name == name {
+			return certificate.DNSProvider{
+				Provider:  provider.Provider,
+				Settings:  provider.Settings,
+				VaultPath: provider.VaultPath,
+				Timing:    dnsTiming(provider.TTL, provider.PropagationTimeout, provider.PollingInterval),
+			}
+		}
+	}
+
+	return certificate.DNSProvider{Provider: name}
+}
+
+// dnsTiming converts DNS timing options in seconds to certificate DNS timing
+func dnsTiming(ttl, propagationTimeout, pollingInterval int) certificate.DNSTiming {
+	return certificate.DNSTiming{
+		TTL:                ttl,
+		PropagationTimeout: time.Duration(propagationTimeout) * time.Second,
+		PollingInterval:    time.Duration(pollingInterval) * time.Second,
+	}
+}
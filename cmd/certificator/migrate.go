@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/config"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// migrateVaultPaths moves certificates stored at locations of previous path layout
+// to locations of the configured one
+func migrateVaultPaths(args []string, cfg config.Config, vaultClient *vault.VaultClient, logger *logrus.Logger) {
+	flags := flag.NewFlagSet("migrate-vault-paths", flag.ExitOnError)
+	from := flags.String("from", "", "Vault path template certificates are currently stored at, "+
+		"certificates/<name> layout of previous versions if not set")
+	dryRun := flags.Bool("dry-run", false, "only log certificates that would be moved")
+	_ = flags.Parse(args)
+
+	var failedDomains []string
+	for _, dom := range cfg.Domains {
+		entryLogger := logger.WithField("domains_file", dom.Source)
+
+		// Locations set explicitly do not depend on the layout
+		if dom.VaultPath != "" {
+			continue
+		}
+
+		destination, err := cfg.CertificateLocation(dom)
+		if err != nil {
+			failedDomains = append(failedDomains, dom.Name)
+			entryLogger.Error(err)
+			continue
+		}
+
+		sources, err := migrationSources(dom, *from, cfg.Environment)
+		if err != nil {
+			failedDomains = append(failedDomains, dom.Name)
+			entryLogger.Error(err)
+			continue
+		}
+		for _, source := range sources {
+			if source == destination {
+				continue
+			}
+
+			moved, err := moveSecret(source, destination, *dryRun, vaultClient, entryLogger)
+			if err != nil {
+				failedDomains = append(failedDomains, dom.Name)
+				entryLogger.Error(err)
+				break
+			}
+			if moved {
+				entryLogger.Infof("certificate for %s moved from %s to %s", dom.Name, source, destination)
+				break
+			}
+		}
+	}
+
+	if len(failedDomains) > 0 {
+		logger.Fatalf("Failed to migrate certificates for: %v", failedDomains)
+	}
+}
+
+// moveSecret copies secret to destination and deletes it at source.
+// Secret is not moved if it is missing at source or destination already exists,
+// so that migration can be run repeatedly
+func moveSecret(source, destination string, dryRun bool, vaultClient *vault.VaultClient,
+	logger *logrus.Entry) (bool, error) {
+	secrets, err := vaultClient.KVRead(source)
+	if err != nil || secrets == nil {
+		return false, err
+	}
+
+	existing, version, err := vaultClient.KVReadVersion(destination)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		logger.Warnf("not moving %s, %s already exists", source, destination)
+		return false, nil
+	}
+
+	if dryRun {
+		logger.Infof("would move %s to %s", source, destination)
+		return false, nil
+	}
+
+	payload := make(map[string]string, len(secrets))
+	for key, value := range secrets {
+		if value, ok := value.(string); ok {
+			payload[key] = value
+		}
+	}
+	// Destination must still be missing when it is written
+	if _, err := vaultClient.KVWriteCAS(destination, payload, version); err != nil {
+		return false, err
+	}
+
+	return true, vaultClient.KVDelete(source)
+}
+
+// migrationSources returns locations certificate of entry may be stored at by previous versions.
+// Names were not normalized before, so location of the name as written in domains file comes first
+func migrationSources(dom config.Domain, from, environment string) ([]string, error) {
+	names := []string{dom.Name}
+	if dom.RawName != "" && dom.RawName != dom.Name {
+		names = []string{dom.RawName, dom.Name}
+	}
+
+	sources := make([]string, 0, len(names))
+	for _, name := range names {
+		source := "certificates/" + name
+		if from != "" {
+			var err error
+			if source, err = vault.RenderPath(from, vault.PathVariables{Domain: name, Group: dom.Group,
+				Environment: environment}); err != nil {
+				return nil, err
+			}
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/acme"
+	"github.com/vinted/certificator/pkg/certificate"
+	"github.com/vinted/certificator/pkg/config"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// revoke revokes certificate of a domain stored in Vault
+func revoke(args []string, cfg config.Config, cas *caClients, vaultClient *vault.VaultClient, logger *logrus.Logger) {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	domain := flags.String("domain", "", "main (first) domain of the certificate, as defined in domains file")
+	reasonName := flags.String("reason", "unspecified",
+		"RFC 5280 revocation reason name or code, e.g. keyCompromise, superseded, cessationOfOperation")
+	useCertKey := flags.Bool("use-certificate-key", false,
+		"sign revocation request with certificate private key instead of account key")
+	_ = flags.Parse(args)
+
+	if *domain == "" {
+		logger.Fatal("domain of the certificate to revoke is required")
+	}
+
+	reason, err := acme.ParseRevocationReason(*reasonName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Certificates of domains missing in domains file are looked up in the location of global path template
+	entry, _, err := domainEntry(cfg, *domain)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	name := entry.Name
+	location, err := cfg.CertificateLocation(entry)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Certificate can be revoked only by CA that issued it
+	caURL, err := certificate.GetCertificateCA(location, vaultClient)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	issuer, known := cas.byURL(caURL)
+	if !known {
+		logger.Fatalf("certificate for %s was issued by CA %s, which is not configured", name, caURL)
+	}
+	acmeClient, err := cas.client(issuer)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	logger.Infof("revoking certificate for %s", name)
+	if err := certificate.RevokeCertificate(acmeClient, vaultClient, location, reason, *useCertKey); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("certificate for %s revoked, it will be reissued on the next run", name)
+}
+
+// domainEntry returns domains file entry of main domain, entry with only the domain is returned
+// if it is not in domains file
+func domainEntry(cfg config.Config, domain string) (config.Domain, bool, error) {
+	name, err := config.NormalizeDomain(domain)
+	if err != nil {
+		return config.Domain{}, false, err
+	}
+
+	for _, dom := range cfg.Domains {
+		if dom.Name == name {
+			return dom, true, nil
+		}
+	}
+
+	return config.Domain{Name: name}, false, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/certificate"
+	"github.com/vinted/certificator/pkg/config"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// rollback restores previous version of certificate of a domain stored in Vault
+func rollback(args []string, cfg config.Config, vaultClient *vault.VaultClient, logger *logrus.Logger) {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	domain := flags.String("domain", "", "main (first) domain of the certificate, as defined in domains file")
+	version := flags.Int("version", 0, "Vault secret version to restore, the previous one if not set")
+	_ = flags.Parse(args)
+
+	if *domain == "" {
+		logger.Fatal("domain of the certificate to roll back is required")
+	}
+	if *version < 0 {
+		logger.Fatal("version must be positive")
+	}
+
+	// Restored certificate is checked against domains of the entry
+	entry, found, err := domainEntry(cfg, *domain)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if !found {
+		logger.Fatalf("%s is not defined in domains file", entry.Name)
+	}
+	location, err := cfg.CertificateLocation(entry)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	entryLogger := logger.WithField("domains_file", entry.Source)
+	restored, err := certificate.RollbackCertificate(location, *version, entry.AllDomains(), vaultClient,
+		entryLogger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	entryLogger.Infof("certificate for %s rolled back to version %d", entry.Name, restored)
+}
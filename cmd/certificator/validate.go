@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/config"
+)
+
+// validate reports problems of domains file and exits with non-zero status if there are any
+func validate(cfg config.Config, logger *logrus.Logger) {
+	errs := config.ValidateDomains(cfg.Domains, cfg.MaxSANs, cfg.CertificateLocation)
+	for _, err := range errs {
+		logger.Error(err)
+	}
+
+	if len(errs) > 0 {
+		logger.Errorf("%s has %d problems", cfg.DomainsFile, len(errs))
+		os.Exit(1)
+	}
+	logger.Infof("%s is valid", cfg.DomainsFile)
+}
@@ -3,16 +3,19 @@ module github.com/vinted/certificator
 go 1.16
 
 require (
-	github.com/go-acme/lego v2.7.2+incompatible
+	github.com/aws/aws-sdk-go v1.42.8
 	github.com/go-acme/lego/v4 v4.5.3
 	github.com/go-test/deep v1.0.8 // indirect
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/hcl v1.0.1-vault-3 // indirect
 	github.com/hashicorp/vault/api v1.3.1
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/miekg/dns v1.1.43
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/thanos-io/thanos v0.24.0
+	golang.org/x/net v0.0.0-20211020060615-d418f374d309
+	gopkg.in/square/go-jose.v2 v2.6.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -1,14 +1,22 @@
 package acme
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 
+	"github.com/go-acme/lego/v4/acme/api"
 	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/sirupsen/logrus"
@@ -18,9 +26,17 @@ import (
 // User represents a users local saved credentials.
 // Implements registration.User interface
 type User struct {
-	Email        string
-	Registration *registration.Resource
-	key          crypto.PrivateKey
+	Email                  string
+	Registration           *registration.Resource
+	ExternalAccountBinding *ExternalAccountBinding `json:",omitempty"`
+	key                    crypto.PrivateKey
+}
+
+// ExternalAccountBinding contains credentials issued by CA
+// that are used to bind ACME account to an existing CA customer account
+type ExternalAccountBinding struct {
+	KeyID   string
+	HMACKey string
 }
 
 // GetEmail returns the email address for the account.
@@ -38,35 +54,205 @@ func (u *User) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
+// Client wraps lego client and implements ACME features lego does not support
+type Client struct {
+	*lego.Client
+	serverURL   string
+	accountPath string
+	user        *User
+	directory   directory
+	httpClient  *http.Client
+	orders      *orderTransport
+	logger      *logrus.Logger
+}
+
+// directory contains ACME directory resources that are not exposed by lego
+type directory struct {
+	NewNonceURL  string `json:"newNonce"`
+	NewOrderURL  string `json:"newOrder"`
+	KeyChangeURL string `json:"keyChange"`
+	RenewalInfo  string `json:"renewalInfo"`
+}
+
 // NewClient initializes acme client and returns
 func NewClient(
 	email, serverURL string,
+	eab ExternalAccountBinding,
 	reregister bool,
 	vault *vault.VaultClient,
-	logger *logrus.Logger) (*lego.Client, error) {
+	logger *logrus.Logger) (*Client, error) {
+
+	path, err := AccountPath(serverURL, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateLegacyAccount(path, serverURL, vault, logger); err != nil {
+		return nil, err
+	}
+	if err := migrateAccountEmail(path, serverURL, email, vault, logger); err != nil {
+		return nil, err
+	}
+
+	acc, err := setupAccount(path, email, reregister, vault, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := lego.NewConfig(acc).HTTPClient
+	dir, err := getDirectory(httpClient, serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := &orderTransport{next: httpClient.Transport, newOrderURL: dir.NewOrderURL, user: acc}
+	httpClient.Transport = orders
 
-	acc, err := setupAccount(email, reregister, vault, logger)
+	if err := recoverKeyRollover(path, acc, httpClient, serverURL, vault, logger); err != nil {
+		return nil, err
+	}
+
+	client, err := setupClient(acc, serverURL, httpClient, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := setupClient(acc, serverURL, logger)
+	client, err = registerAccount(path, acc, client, vault, serverURL, httpClient, eab, reregister, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	return registerAccount(acc, client, vault, serverURL, reregister, logger)
+	return &Client{
+		Client:      client,
+		serverURL:   serverURL,
+		accountPath: path,
+		user:        acc,
+		directory:   dir,
+		httpClient:  httpClient,
+		orders:      orders,
+		logger:      logger,
+	}, nil
+}
+
+// Obtain obtains certificate. If replaces is not empty, the new order
+// is marked as a replacement of certificate with that ARI identifier.
+func (c *Client) Obtain(request certificate.ObtainRequest, replaces string) (*certificate.Resource, error) {
+	c.orders.setReplaces(replaces)
+	defer c.orders.setReplaces("")
+
+	return c.Certificate.Obtain(request)
+}
+
+// AlternateChains returns certificate bundles with alternate chains CA offers for obtained certificate,
+// ordered by their URL. The chain of obtained certificate itself is not included.
+func (c *Client) AlternateChains(certRes *certificate.Resource) ([][]byte, error) {
+	core, err := c.newCore(c.user.GetRegistration().URI, c.user.GetPrivateKey())
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := core.Certificates.GetAll(certRes.CertURL, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting alternate chains: %w", err)
+	}
+
+	urls := make([]string, 0, len(certs))
+	for url, cert := range certs {
+		if !bytes.Equal(cert.Issuer, certRes.IssuerCertificate) {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+
+	chains := make([][]byte, 0, len(urls))
+	for _, url := range urls {
+		chains = append(chains, certs[url].Cert)
+	}
+
+	return chains, nil
+}
+
+// Deactivate deactivates ACME account at CA and removes it together with its key from Vault.
+// Deactivated account cannot be used anymore, a new one is registered on the next run.
+func (c *Client) Deactivate(vault *vault.VaultClient) error {
+	if err := c.Registration.DeleteRegistration(); err != nil {
+		return fmt.Errorf("failed deactivating account: %w", err)
+	}
+	c.logger.Infof("account %s deactivated", c.user.GetRegistration().URI)
+
+	if err := vault.KVDelete(c.accountPath + "account"); err != nil {
+		return err
+	}
+
+	return vault.KVDelete(c.accountPath + "key")
+}
+
+// newCore creates lego ACME API core, which signs requests with given key.
+// If kid is empty, public key is embedded into requests instead of account URL.
+func (c *Client) newCore(kid string, key crypto.PrivateKey) (*api.Core, error) {
+	return api.New(c.httpClient, "", c.serverURL, kid, key)
+}
+
+func getDirectory(httpClient *http.Client, serverURL string) (directory, error) {
+	var dir directory
+
+	resp, err := httpClient.Get(serverURL)
+	if err != nil {
+		return dir, fmt.Errorf("failed getting ACME directory: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return dir, fmt.Errorf("failed getting ACME directory, got status: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return dir, fmt.Errorf("failed decoding ACME directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// AccountPath returns location in Vault KV storage where account and key
+// for given ACME directory and account email are stored.
+// Accounts of different CAs and emails are kept side by side, e.g.
+// accounts/acme-v02.api.letsencrypt.org_directory/user@example.com/
+func AccountPath(serverURL, email string) (string, error) {
+	directory, err := directoryPath(serverURL)
+	if err != nil {
+		return "", err
+	}
+
+	return directory + email + "/", nil
+}
+
+// directoryPath returns location in Vault KV storage accounts of given ACME directory are stored under
+func directoryPath(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("ACME server URL %q has no host", serverURL)
+	}
+
+	directory := u.Host + strings.TrimSuffix(u.Path, "/")
+	directory = strings.NewReplacer(":", "_", "/", "_").Replace(directory)
+
+	return "accounts/" + directory + "/", nil
 }
 
 func setupClient(
 	acc *User,
 	serverURL string,
+	httpClient *http.Client,
 	logger *logrus.Logger) (*lego.Client, error) {
 
 	logger.Debug("setting up client")
 
 	clientConfig := lego.NewConfig(acc)
 	clientConfig.CADirURL = serverURL
+	clientConfig.HTTPClient = httpClient
 
 	client, err := lego.NewClient(clientConfig)
 	if err != nil {
@@ -77,20 +263,20 @@ func setupClient(
 }
 
 func setupAccount(
-	email string,
+	path, email string,
 	reregister bool,
 	vault *vault.VaultClient,
 	logger *logrus.Logger) (*User, error) {
 
 	var acc *User
 
-	secrets, err := vault.KVRead("account")
+	secrets, err := vault.KVRead(path + "account")
 	if err != nil {
 		return nil, err
 	}
 
 	if secrets == nil {
-		acc, err = newAccount(email, reregister, vault, logger)
+		acc, err = newAccount(path, email, reregister, vault, logger)
 		if err != nil {
 			return nil, err
 		}
@@ -104,18 +290,24 @@ func setupAccount(
 			return nil, err
 		}
 
-		acc.key, err = getAccountKey(reregister, vault, logger)
+		acc.key, err = getAccountKey(path, reregister, vault, logger)
 		if err != nil {
 			return nil, err
 		}
+
+		// Registration contact is synchronized with the configured email in registerAccount
+		if acc.Email != email {
+			logger.Infof("account email changed from %q to %q", acc.Email, email)
+			acc.Email = email
+		}
 		return acc, nil
 	}
 
 	return nil, errors.New("failed reading account from vault")
 }
 
-func newAccount(email string, reregister bool, vault *vault.VaultClient, logger *logrus.Logger) (*User, error) {
-	key, err := getAccountKey(reregister, vault, logger)
+func newAccount(path, email string, reregister bool, vault *vault.VaultClient, logger *logrus.Logger) (*User, error) {
+	key, err := getAccountKey(path, reregister, vault, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -126,13 +318,13 @@ func newAccount(email string, reregister bool, vault *vault.VaultClient, logger
 	}, nil
 }
 
-func getAccountKey(reregister bool, vault *vault.VaultClient, logger *logrus.Logger) (crypto.PrivateKey, error) {
+func getAccountKey(path string, reregister bool, vault *vault.VaultClient, logger *logrus.Logger) (crypto.PrivateKey, error) {
 	var (
 		keyDecoded crypto.PrivateKey
 		err        error
 	)
 
-	secrets, err := vault.KVRead("key")
+	secrets, err := vault.KVRead(path + "key")
 	if err != nil {
 		return nil, err
 	}
@@ -149,32 +341,79 @@ func getAccountKey(reregister bool, vault *vault.VaultClient, logger *logrus.Log
 			return nil, err
 		}
 		keyEncoded := certcrypto.PEMEncode(keyDecoded)
-		return keyDecoded, saveKey(keyEncoded, vault, logger)
+		return keyDecoded, saveKey(path, keyEncoded, vault, logger)
 	} else {
 		return nil, errors.New("key not found and re-registering is disabled")
 	}
 }
 
-func registerAccount(acc *User, client *lego.Client, vault *vault.VaultClient,
-	serverURL string, reregister bool, logger *logrus.Logger) (*lego.Client, error) {
+func registerAccount(path string, acc *User, client *lego.Client, vault *vault.VaultClient,
+	serverURL string, httpClient *http.Client, eab ExternalAccountBinding,
+	reregister bool, logger *logrus.Logger) (*lego.Client, error) {
 	logger.Debug("checking client registration")
-	_, err := client.Registration.QueryRegistration()
+	reg, err := client.Registration.QueryRegistration()
 	if err != nil {
 		logger.Warn("registration not found")
 
-		client, err = recoverAccount(acc, client, vault, serverURL, reregister, logger)
+		client, err = recoverAccount(path, acc, client, vault, serverURL, httpClient, eab, reregister, logger)
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		logger.Debug("account is registered correctly")
+
+		acc.Registration.Body = reg.Body
+		updated, err := syncContact(acc, client, logger)
+		if err != nil {
+			return nil, err
+		}
+		if updated {
+			return client, saveAccount(path, acc, vault, logger)
+		}
 	}
 
 	return client, nil
 }
 
-func recoverAccount(acc *User, client *lego.Client, vault *vault.VaultClient,
-	serverURL string, reregister bool, logger *logrus.Logger) (*lego.Client, error) {
+// syncContact updates account contacts at CA if they differ from account email.
+// Returns true if registration was updated.
+func syncContact(acc *User, client *lego.Client, logger *logrus.Logger) (bool, error) {
+	contact := []string{}
+	if acc.Email != "" {
+		contact = []string{"mailto:" + acc.Email}
+	}
+
+	if contactsEqual(acc.Registration.Body.Contact, contact) {
+		return false, nil
+	}
+
+	logger.Infof("updating account contact from %v to %v", acc.Registration.Body.Contact, contact)
+	reg, err := client.Registration.UpdateRegistration(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		return false, fmt.Errorf("failed updating account contact: %w", err)
+	}
+	acc.Registration = reg
+
+	return true, nil
+}
+
+func contactsEqual(contacts1, contacts2 []string) bool {
+	if len(contacts1) != len(contacts2) {
+		return false
+	}
+
+	for i := range contacts1 {
+		if !strings.EqualFold(contacts1[i], contacts2[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func recoverAccount(path string, acc *User, client *lego.Client, vault *vault.VaultClient,
+	serverURL string, httpClient *http.Client, eab ExternalAccountBinding,
+	reregister bool, logger *logrus.Logger) (*lego.Client, error) {
 	// Try to resolve registration by private key
 	reg, err := client.Registration.ResolveAccountByKey()
 
@@ -185,40 +424,243 @@ func recoverAccount(acc *User, client *lego.Client, vault *vault.VaultClient,
 			// Reset local registration data and reregister
 			logger.Info("reregistering account")
 			acc.Registration = nil
-			client, err = setupClient(acc, serverURL, logger)
+			client, err = setupClient(acc, serverURL, httpClient, logger)
 			if err != nil {
 				return nil, err
 			}
 
-			reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+			binding, err := externalAccountBinding(path, acc, eab, vault)
+			if err != nil {
+				return nil, err
+			}
+
+			if binding != nil {
+				logger.Info("registering account with external account binding")
+				reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+					TermsOfServiceAgreed: true,
+					Kid:                  binding.KeyID,
+					HmacEncoded:          binding.HMACKey,
+				})
+			} else {
+				reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+			}
 			if err != nil {
 				return nil, err
 			}
 			acc.Registration = reg
+			acc.ExternalAccountBinding = binding
 		} else {
 			return nil, errors.New("account registration not found and re-registering is disabled")
 		}
 	} else {
 		logger.Info("account resolved by key")
 		acc.Registration = reg
+
+		if _, err := syncContact(acc, client, logger); err != nil {
+			return nil, err
+		}
 	}
 
 	// Save new account registration
-	return client, saveAccount(acc, vault, logger)
+	return client, saveAccount(path, acc, vault, logger)
+}
+
+// externalAccountBinding returns EAB credentials used for registration.
+// Configured credentials take precedence over the ones saved with the account,
+// if neither is present credentials are read from Vault `eab` path next to the account.
+// Returns nil if CA does not need external account binding.
+func externalAccountBinding(path string, acc *User, eab ExternalAccountBinding,
+	vault *vault.VaultClient) (*ExternalAccountBinding, error) {
+	if (eab.KeyID == "") != (eab.HMACKey == "") {
+		return nil, errors.New("external account binding needs both key ID and HMAC key")
+	}
+	if eab.KeyID != "" {
+		return &eab, nil
+	}
+
+	if acc.ExternalAccountBinding != nil {
+		return acc.ExternalAccountBinding, nil
+	}
+
+	secrets, err := vault.KVRead(path + "eab")
+	if err != nil {
+		return nil, err
+	}
+	if secrets == nil {
+		return nil, nil
+	}
+
+	keyID, kidOk := secrets["kid"].(string)
+	hmacKey, hmacOk := secrets["hmac_key"].(string)
+	if !kidOk || !hmacOk {
+		return nil, errors.New("external account binding read from vault cannot be used")
+	}
+
+	return &ExternalAccountBinding{KeyID: keyID, HMACKey: hmacKey}, nil
+}
+
+// migrateLegacyAccount moves account and key stored in the flat layout
+// (`account` and `key` directly under the KV prefix) to the namespaced path,
+// if the legacy account belongs to the same CA.
+func migrateLegacyAccount(path, serverURL string, vault *vault.VaultClient, logger *logrus.Logger) error {
+	secrets, err := vault.KVRead(path + "account")
+	if err != nil {
+		return err
+	}
+	if secrets != nil {
+		return nil
+	}
+
+	legacyAccount, err := vault.KVRead("account")
+	if err != nil {
+		return err
+	}
+	accountInfo, ok := legacyAccount["account"].(string)
+	if !ok {
+		return nil
+	}
+
+	var acc *User
+	if err := json.Unmarshal([]byte(accountInfo), &acc); err != nil {
+		return err
+	}
+
+	// Contact of migrated account is updated if configured email differs from the stored one
+	if !sameHost(acc.Registration, serverURL) {
+		logger.Debug("legacy account belongs to different CA, not migrating it")
+		return nil
+	}
+
+	legacyKey, err := vault.KVRead("key")
+	if err != nil {
+		return err
+	}
+	key, ok := legacyKey["pem"].(string)
+	if !ok {
+		logger.Warn("legacy account has no usable key, not migrating it")
+		return nil
+	}
+
+	logger.Infof("migrating legacy ACME account to %s", path)
+	if err := saveKey(path, []byte(key), vault, logger); err != nil {
+		return err
+	}
+	if err := vault.KVWrite(path+"account", map[string]string{"account": accountInfo}); err != nil {
+		return err
+	}
+
+	if err := vault.KVDelete("account"); err != nil {
+		return err
+	}
+
+	return vault.KVDelete("key")
+}
+
+// accountSecrets are secrets stored at account path
+var accountSecrets = []string{"key", "key_rollover", "eab", "account"}
+
+// migrateAccountEmail moves account stored for the same ACME directory under another email to path,
+// so that changing account email keeps using the registered account, its contact is updated
+// in registerAccount. Nothing is moved if there are several such accounts, as it is not known which one to use
+func migrateAccountEmail(path, serverURL, email string, vault *vault.VaultClient, logger *logrus.Logger) error {
+	secrets, err := vault.KVRead(path + "account")
+	if err != nil || secrets != nil {
+		return err
+	}
+
+	directory, err := directoryPath(serverURL)
+	if err != nil {
+		return err
+	}
+	keys, err := vault.KVList(directory)
+	if err != nil {
+		return err
+	}
+
+	var previous []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") || key == email+"/" {
+			continue
+		}
+		// Deleted KV v2 secrets are still listed
+		secrets, err := vault.KVRead(directory + key + "account")
+		if err != nil {
+			return err
+		}
+		if secrets != nil {
+			previous = append(previous, directory+key)
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	if len(previous) > 1 {
+		logger.Warnf("several accounts are stored under %s, not moving any of them to %s", directory, path)
+		return nil
+	}
+
+	// Account is copied last, so that interrupted move is repeated on the next run
+	logger.Infof("moving ACME account from %s to %s", previous[0], path)
+	for _, name := range accountSecrets {
+		secrets, err := vault.KVRead(previous[0] + name)
+		if err != nil {
+			return err
+		}
+		if secrets == nil {
+			continue
+		}
+
+		payload := make(map[string]string, len(secrets))
+		for key, value := range secrets {
+			if value, ok := value.(string); ok {
+				payload[key] = value
+			}
+		}
+		if err := vault.KVWrite(path+name, payload); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range accountSecrets {
+		if err := vault.KVDelete(previous[0] + name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sameHost reports whether registration was made at the CA serving serverURL.
+// Registrations without URI are assumed to match.
+func sameHost(reg *registration.Resource, serverURL string) bool {
+	if reg == nil || reg.URI == "" {
+		return true
+	}
+
+	regURL, err := url.Parse(reg.URI)
+	if err != nil {
+		return false
+	}
+	dirURL, err := url.Parse(serverURL)
+	if err != nil {
+		return false
+	}
+
+	return regURL.Host == dirURL.Host
 }
 
-func saveAccount(account *User, vault *vault.VaultClient, logger *logrus.Logger) error {
+func saveAccount(path string, account *User, vault *vault.VaultClient, logger *logrus.Logger) error {
 	logger.Info("saving ACME account")
 	jsonAccount, err := json.Marshal(account)
 	if err != nil {
 		return err
 	}
 
-	return vault.KVWrite("account", map[string]string{"account": string(jsonAccount)})
+	return vault.KVWrite(path+"account", map[string]string{"account": string(jsonAccount)})
 }
 
-func saveKey(key []byte, vault *vault.VaultClient, logger *logrus.Logger) error {
+func saveKey(path string, key []byte, vault *vault.VaultClient, logger *logrus.Logger) error {
 	logger.Info("saving ACME account key")
 
-	return vault.KVWrite("key", map[string]string{"pem": string(key)})
+	return vault.KVWrite(path+"key", map[string]string{"pem": string(key)})
 }
@@ -0,0 +1,341 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/sirupsen/logrus"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/vinted/certificator/pkg/vault"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const testAccountPath = "accounts/pebble_14000_dir/test@test.com/"
+
+// setenv sets environment variable for the duration of test
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	os.Setenv(key, value)
+}
+
+// newTestVault starts Vault KV v1 mock that serves eab secret if it is set,
+// written secrets are stored in written. Returns number of eab secret reads
+func newTestVault(t *testing.T, eab map[string]interface{}, written map[string]interface{}) (*vault.VaultClient,
+	*int) {
+	var eabReads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/kv/certificator/"+testAccountPath+"eab" && r.Method == http.MethodGet:
+			eabReads++
+			if eab == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": eab})
+		case r.Method == http.MethodPut:
+			var value map[string]interface{}
+			testutil.Ok(t, json.NewDecoder(r.Body).Decode(&value))
+			written[r.URL.Path] = value
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	setenv(t, "VAULT_ADDR", srv.URL)
+
+	client, err := vault.NewVaultClientWithAuth(vault.Auth{Method: vault.AuthToken, Token: "token"},
+		"kv/certificator/", logrus.New())
+	testutil.Ok(t, err)
+	t.Cleanup(client.Close)
+
+	return client, &eabReads
+}
+
+func TestAccountPath(t *testing.T) {
+	for _, tcase := range []struct {
+		tcaseName    string
+		serverURL    string
+		email        string
+		expectedPath string
+		expectedErr  bool
+	}{
+		{
+			tcaseName:    "let's encrypt staging directory",
+			serverURL:    "https://acme-staging-v02.api.letsencrypt.org/directory",
+			email:        "test@test.com",
+			expectedPath: "accounts/acme-staging-v02.api.letsencrypt.org_directory/test@test.com/",
+		},
+		{
+			tcaseName:    "directory with port and trailing slash",
+			serverURL:    "https://pebble:14000/dir/",
+			email:        "test@test.com",
+			expectedPath: "accounts/pebble_14000_dir/test@test.com/",
+		},
+		{
+			tcaseName:   "directory URL without host",
+			serverURL:   "directory",
+			email:       "test@test.com",
+			expectedErr: true,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			path, err := AccountPath(tcase.serverURL, tcase.email)
+			if tcase.expectedErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedPath, path)
+		})
+	}
+}
+
+func TestSameHost(t *testing.T) {
+	for _, tcase := range []struct {
+		tcaseName      string
+		registration   *registration.Resource
+		serverURL      string
+		expectedResult bool
+	}{
+		{
+			tcaseName:      "registration without URI",
+			registration:   &registration.Resource{},
+			serverURL:      "https://pebble:14000/dir",
+			expectedResult: true,
+		},
+		{
+			tcaseName:      "registration made at the same CA",
+			registration:   &registration.Resource{URI: "https://pebble:14000/my-account/1"},
+			serverURL:      "https://pebble:14000/dir",
+			expectedResult: true,
+		},
+		{
+			tcaseName:      "registration made at a different CA",
+			registration:   &registration.Resource{URI: "https://acme-v02.api.letsencrypt.org/acme/acct/1"},
+			serverURL:      "https://acme-staging-v02.api.letsencrypt.org/directory",
+			expectedResult: false,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			testutil.Equals(t, tcase.expectedResult, sameHost(tcase.registration, tcase.serverURL))
+		})
+	}
+}
+
+func TestContactsEqual(t *testing.T) {
+	for _, tcase := range []struct {
+		tcaseName      string
+		contacts1      []string
+		contacts2      []string
+		expectedResult bool
+	}{
+		{
+			tcaseName:      "same contacts",
+			contacts1:      []string{"mailto:test@test.com"},
+			contacts2:      []string{"mailto:test@test.com"},
+			expectedResult: true,
+		},
+		{
+			tcaseName:      "contacts differ in case",
+			contacts1:      []string{"mailto:Test@Test.com"},
+			contacts2:      []string{"mailto:test@test.com"},
+			expectedResult: true,
+		},
+		{
+			tcaseName:      "different contacts",
+			contacts1:      []string{"mailto:old@test.com"},
+			contacts2:      []string{"mailto:test@test.com"},
+			expectedResult: false,
+		},
+		{
+			tcaseName:      "no contacts at CA",
+			contacts1:      nil,
+			contacts2:      []string{"mailto:test@test.com"},
+			expectedResult: false,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			testutil.Equals(t, tcase.expectedResult, contactsEqual(tcase.contacts1, tcase.contacts2))
+		})
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	configured := ExternalAccountBinding{KeyID: "configured-kid", HMACKey: "configured-hmac"}
+	saved := &ExternalAccountBinding{KeyID: "saved-kid", HMACKey: "saved-hmac"}
+	stored := map[string]interface{}{"kid": "vault-kid", "hmac_key": "vault-hmac"}
+
+	for _, tcase := range []struct {
+		name          string
+		eab           ExternalAccountBinding
+		saved         *ExternalAccountBinding
+		vaultEAB      map[string]interface{}
+		expected      *ExternalAccountBinding
+		expectedReads int
+		err           bool
+	}{
+		{
+			name:     "configured credentials take precedence",
+			eab:      configured,
+			saved:    saved,
+			vaultEAB: stored,
+			expected: &configured,
+		},
+		{
+			name:     "saved credentials take precedence over vault",
+			saved:    saved,
+			vaultEAB: stored,
+			expected: saved,
+		},
+		{
+			name:          "credentials read from vault",
+			vaultEAB:      stored,
+			expected:      &ExternalAccountBinding{KeyID: "vault-kid", HMACKey: "vault-hmac"},
+			expectedReads: 1,
+		},
+		{
+			name:          "no credentials",
+			expectedReads: 1,
+		},
+		{
+			name:          "incomplete credentials in vault",
+			vaultEAB:      map[string]interface{}{"kid": "vault-kid"},
+			expectedReads: 1,
+			err:           true,
+		},
+		{
+			name:     "configured key ID only",
+			eab:      ExternalAccountBinding{KeyID: "configured-kid"},
+			vaultEAB: stored,
+			err:      true,
+		},
+		{
+			name:     "configured HMAC key only",
+			eab:      ExternalAccountBinding{HMACKey: "configured-hmac"},
+			vaultEAB: stored,
+			err:      true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			vaultClient, eabReads := newTestVault(t, tcase.vaultEAB, map[string]interface{}{})
+
+			binding, err := externalAccountBinding(testAccountPath, &User{ExternalAccountBinding: tcase.saved},
+				tcase.eab, vaultClient)
+			testutil.Equals(t, tcase.expectedReads, *eabReads)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, binding)
+		})
+	}
+}
+
+func TestRecoverAccountWithExternalAccountBinding(t *testing.T) {
+	hmacKey := base64.RawURLEncoding.EncodeToString([]byte("secret hmac key"))
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	var (
+		srvURL        string
+		registrations int
+	)
+
+	smux := http.NewServeMux()
+	smux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   srvURL + "/new-nonce",
+			"newAccount": srvURL + "/new-account",
+			"newOrder":   srvURL + "/new-order",
+			"meta":       map[string]interface{}{"externalAccountRequired": true},
+		})
+	})
+	smux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	smux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		body, err := io.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		jws, err := jose.ParseSigned(string(body))
+		testutil.Ok(t, err)
+		payload, err := jws.Verify(accountKey.Public())
+		testutil.Ok(t, err)
+
+		var account struct {
+			OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+			ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+		}
+		testutil.Ok(t, json.Unmarshal(payload, &account))
+
+		// Account key is not registered yet
+		if account.OnlyReturnExisting {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:accountDoesNotExist", "status": 400}`))
+			return
+		}
+		registrations++
+
+		binding, err := jose.ParseSigned(string(account.ExternalAccountBinding))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "vault-kid", binding.Signatures[0].Protected.KeyID)
+		key, err := base64.RawURLEncoding.DecodeString(hmacKey)
+		testutil.Ok(t, err)
+		_, err = binding.Verify(key)
+		testutil.Ok(t, err)
+
+		w.Header().Set("Location", srvURL+"/account/1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status": "valid", "contact": ["mailto:test@test.com"]}`))
+	})
+
+	srv := httptest.NewServer(smux)
+	t.Cleanup(srv.Close)
+	srvURL = srv.URL
+
+	written := map[string]interface{}{}
+	vaultClient, eabReads := newTestVault(t, map[string]interface{}{"kid": "vault-kid", "hmac_key": hmacKey},
+		written)
+
+	logger := logrus.New()
+	acc := &User{Email: "test@test.com", key: accountKey}
+	client, err := setupClient(acc, srv.URL+"/dir", srv.Client(), logger)
+	testutil.Ok(t, err)
+
+	_, err = recoverAccount(testAccountPath, acc, client, vaultClient, srv.URL+"/dir", srv.Client(),
+		ExternalAccountBinding{}, true, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, registrations)
+	testutil.Equals(t, 1, *eabReads)
+	testutil.Equals(t, srv.URL+"/account/1", acc.Registration.URI)
+	testutil.Equals(t, &ExternalAccountBinding{KeyID: "vault-kid", HMACKey: hmacKey}, acc.ExternalAccountBinding)
+
+	// Binding is saved with the account, so that account can be registered again without reading vault
+	saved, ok := written["/v1/kv/certificator/"+testAccountPath+"account"].(map[string]interface{})
+	testutil.Assert(t, ok, "account should be saved to vault, written %v", written)
+	var savedAccount User
+	testutil.Ok(t, json.Unmarshal([]byte(saved["account"].(string)), &savedAccount))
+	testutil.Equals(t, acc.ExternalAccountBinding, savedAccount.ExternalAccountBinding)
+}
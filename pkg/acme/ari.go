@@ -0,0 +1,181 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// RenewalInfo is a renewal window suggested by CA for a certificate,
+// see ACME Renewal Information (ARI) extension, RFC 9773
+type RenewalInfo struct {
+	// CertID is ARI identifier of the certificate renewal info belongs to
+	CertID          string `json:"-"`
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+}
+
+// renewalRand picks renewal times. Global math/rand source is not seeded,
+// so every run would pick the same time within a window
+var (
+	renewalRandMu sync.Mutex
+	renewalRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// ShouldRenew picks a random time within suggested window, as recommended by RFC 9773,
+// and reports whether it has already passed
+func (r *RenewalInfo) ShouldRenew(now time.Time) bool {
+	return !now.Before(r.renewalTime())
+}
+
+// renewalTime returns a random time within suggested window, or its start if the window is empty
+func (r *RenewalInfo) renewalTime() time.Time {
+	start, end := r.SuggestedWindow.Start, r.SuggestedWindow.End
+	if !end.After(start) {
+		return start
+	}
+
+	renewalRandMu.Lock()
+	offset := renewalRand.Int63n(int64(end.Sub(start)))
+	renewalRandMu.Unlock()
+
+	return start.Add(time.Duration(offset))
+}
+
+// CertID returns ARI identifier of certificate, which consists of
+// base64url encoded authority key identifier and serial number
+func CertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("certificate has no authority key identifier")
+	}
+
+	// Serial number is encoded as DER integer without tag and length,
+	// so positive numbers with the highest bit set are prefixed with zero byte
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// GetRenewalInfo queries CA renewalInfo endpoint for suggested renewal window of certificate.
+// Returns nil if certificate is nil, or CA does not provide renewal info for it.
+func (c *Client) GetRenewalInfo(cert *x509.Certificate) (*RenewalInfo, error) {
+	if cert == nil {
+		return nil, nil
+	}
+
+	if c.directory.RenewalInfo == "" {
+		c.logger.Debug("CA does not support ACME renewal information")
+		return nil, nil
+	}
+
+	certID, err := CertID(cert)
+	if err != nil {
+		c.logger.Debugf("cannot query renewal information: %s", err)
+		return nil, nil
+	}
+
+	resp, err := c.httpClient.Get(strings.TrimSuffix(c.directory.RenewalInfo, "/") + "/" + certID)
+	if err != nil {
+		return nil, fmt.Errorf("failed querying renewal information: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		c.logger.Debugf("CA has no renewal information for certificate %s", certID)
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed querying renewal information, got status: %s", resp.Status)
+	}
+
+	info := &RenewalInfo{CertID: certID}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("failed decoding renewal information: %w", err)
+	}
+
+	return info, nil
+}
+
+// orderTransport adds `replaces` field to new order requests, which lego does not support.
+// The request is re-signed with account key keeping the original protected header.
+type orderTransport struct {
+	next        http.RoundTripper
+	newOrderURL string
+	user        *User
+
+	mu       sync.Mutex
+	replaces string
+}
+
+func (t *orderTransport) setReplaces(certID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.replaces = certID
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *orderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	replaces := t.replaces
+	t.mu.Unlock()
+
+	if replaces == "" || req.Method != http.MethodPost || req.URL.String() != t.newOrderURL {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing new order request: %w", err)
+	}
+
+	var order map[string]interface{}
+	if err := json.Unmarshal(signed.UnsafePayloadWithoutVerification(), &order); err != nil {
+		return nil, fmt.Errorf("failed parsing new order payload: %w", err)
+	}
+	order["replaces"] = replaces
+
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+
+	header := signed.Signatures[0].Protected
+	url, _ := header.ExtraHeaders["url"].(string)
+	resigned, err := signJWS(t.user.GetPrivateKey(), header.KeyID, url, header.Nonce, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	newBody := []byte(resigned.FullSerialize())
+	newReq := req.Clone(req.Context())
+	newReq.Body = io.NopCloser(bytes.NewReader(newBody))
+	newReq.ContentLength = int64(len(newBody))
+
+	return t.next.RoundTrip(newReq)
+}
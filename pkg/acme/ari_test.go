@@ -0,0 +1,224 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestCertID(t *testing.T) {
+	for _, tcase := range []struct {
+		tcaseName      string
+		certificate    *x509.Certificate
+		expectedCertID string
+		expectedErr    bool
+	}{
+		{
+			// Example from RFC 9773 section 4.1
+			tcaseName: "serial number with the highest bit set",
+			certificate: &x509.Certificate{
+				AuthorityKeyId: []byte{0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3,
+					0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4},
+				SerialNumber: new(big.Int).SetBytes([]byte{0x87, 0x65, 0x43, 0x21}),
+			},
+			expectedCertID: "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE",
+		},
+		{
+			tcaseName: "serial number without the highest bit set",
+			certificate: &x509.Certificate{
+				AuthorityKeyId: []byte{0x01, 0x02},
+				SerialNumber:   big.NewInt(0x0102),
+			},
+			expectedCertID: "AQI.AQI",
+		},
+		{
+			tcaseName: "certificate without authority key identifier",
+			certificate: &x509.Certificate{
+				SerialNumber: big.NewInt(1234),
+			},
+			expectedErr: true,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			certID, err := CertID(tcase.certificate)
+			if tcase.expectedErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedCertID, certID)
+		})
+	}
+}
+
+func TestShouldRenew(t *testing.T) {
+	now := time.Now()
+
+	for _, tcase := range []struct {
+		tcaseName      string
+		start          time.Time
+		end            time.Time
+		expectedResult bool
+	}{
+		{
+			tcaseName:      "window has passed",
+			start:          now.Add(-2 * time.Hour),
+			end:            now.Add(-time.Hour),
+			expectedResult: true,
+		},
+		{
+			tcaseName:      "window is in the future",
+			start:          now.Add(time.Hour),
+			end:            now.Add(2 * time.Hour),
+			expectedResult: false,
+		},
+		{
+			tcaseName:      "empty window starting in the past",
+			start:          now.Add(-time.Hour),
+			end:            now.Add(-time.Hour),
+			expectedResult: true,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			info := &RenewalInfo{}
+			info.SuggestedWindow.Start = tcase.start
+			info.SuggestedWindow.End = tcase.end
+			testutil.Equals(t, tcase.expectedResult, info.ShouldRenew(now))
+		})
+	}
+}
+
+func TestRenewalTimeIsRandom(t *testing.T) {
+	info := &RenewalInfo{}
+	info.SuggestedWindow.Start = time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)
+	info.SuggestedWindow.End = info.SuggestedWindow.Start.Add(48 * time.Hour)
+
+	picks := make(map[time.Time]bool)
+	for i := 0; i < 10; i++ {
+		renewAt := info.renewalTime()
+		testutil.Assert(t, !renewAt.Before(info.SuggestedWindow.Start) && renewAt.Before(info.SuggestedWindow.End),
+			"renewal time %v should be within window", renewAt)
+		picks[renewAt] = true
+	}
+	testutil.Assert(t, len(picks) > 1, "renewal times should differ across calls")
+}
+
+func TestGetRenewalInfo(t *testing.T) {
+	certificate := &x509.Certificate{
+		AuthorityKeyId: []byte{0x01, 0x02},
+		SerialNumber:   big.NewInt(0x0102),
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/renewal-info/AQI.AQI" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"suggestedWindow": {"start": "2021-01-03T00:00:00Z", "end": "2021-01-07T00:00:00Z"}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tcase := range []struct {
+		tcaseName     string
+		renewalInfo   string
+		certificate   *x509.Certificate
+		expectedStart time.Time
+		expectedNil   bool
+	}{
+		{
+			tcaseName:     "CA supports renewal information",
+			renewalInfo:   srv.URL + "/renewal-info",
+			certificate:   certificate,
+			expectedStart: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			tcaseName:   "CA does not support renewal information",
+			certificate: certificate,
+			expectedNil: true,
+		},
+		{
+			tcaseName:   "CA does not know the certificate",
+			renewalInfo: srv.URL + "/unknown",
+			certificate: certificate,
+			expectedNil: true,
+		},
+		{
+			tcaseName:   "no certificate",
+			renewalInfo: srv.URL + "/renewal-info",
+			expectedNil: true,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			client := &Client{
+				directory:  directory{RenewalInfo: tcase.renewalInfo},
+				httpClient: srv.Client(),
+				logger:     logrus.New(),
+			}
+
+			info, err := client.GetRenewalInfo(tcase.certificate)
+			testutil.Ok(t, err)
+			if tcase.expectedNil {
+				testutil.Assert(t, info == nil, "expected no renewal information")
+				return
+			}
+			testutil.Equals(t, "AQI.AQI", info.CertID)
+			testutil.Equals(t, tcase.expectedStart, info.SuggestedWindow.Start.UTC())
+		})
+	}
+}
+
+func TestOrderTransport(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	var received *jose.JSONWebSignature
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		received, err = jose.ParseSigned(string(body))
+		testutil.Ok(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	newOrderURL := srv.URL + "/new-order"
+	transport := &orderTransport{
+		next:        http.DefaultTransport,
+		newOrderURL: newOrderURL,
+		user:        &User{key: key},
+	}
+	transport.setReplaces("AQI.AQI")
+
+	signed, err := signJWS(key, srv.URL+"/account/1", newOrderURL, "nonce",
+		[]byte(`{"identifiers":[{"type":"dns","value":"test.com"}]}`))
+	testutil.Ok(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, newOrderURL, strings.NewReader(signed.FullSerialize()))
+	testutil.Ok(t, err)
+	_, err = transport.RoundTrip(req)
+	testutil.Ok(t, err)
+
+	payload, err := received.Verify(key.Public())
+	testutil.Ok(t, err)
+
+	var order map[string]interface{}
+	testutil.Ok(t, json.Unmarshal(payload, &order))
+	testutil.Equals(t, "AQI.AQI", order["replaces"])
+	testutil.Equals(t, srv.URL+"/account/1", received.Signatures[0].Protected.KeyID)
+	testutil.Equals(t, "nonce", received.Signatures[0].Protected.Nonce)
+	testutil.Equals(t, newOrderURL, received.Signatures[0].Protected.ExtraHeaders["url"])
+}
@@ -0,0 +1,65 @@
+package acme
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+)
+
+const (
+	errRateLimited    = "urn:ietf:params:acme:error:rateLimited"
+	errServerInternal = "urn:ietf:params:acme:error:serverInternal"
+)
+
+// ShouldFailover checks if err means that CA is currently unable to issue certificates,
+// i.e. it rate limited the request, failed with a server error or could not be reached,
+// so that the order can be retried with another CA. Errors lego reports per domain are checked too
+func ShouldFailover(err error) bool {
+	for _, domainErr := range domainErrors(err) {
+		if ShouldFailover(domainErr) {
+			return true
+		}
+	}
+
+	var problem *legoacme.ProblemDetails
+	if errors.As(err, &problem) {
+		return problem.Type == errRateLimited || problem.Type == errServerInternal ||
+			problem.HTTPStatus >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// domainErrors returns errors of lego error that maps domains to their errors, e.g. of failed order
+// finalization. Such error does not unwrap and its type is not exported, so it is recognized by its kind
+func domainErrors(err error) []error {
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	for ; err != nil; err = errors.Unwrap(err) {
+		value := reflect.ValueOf(err)
+		if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String ||
+			value.Type().Elem() != errorType {
+			continue
+		}
+
+		errs := make([]error, 0, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			if domainErr, ok := iter.Value().Interface().(error); ok {
+				errs = append(errs, domainErr)
+			}
+		}
+
+		return errs
+	}
+
+	return nil
+}
+
+// ServerURL returns ACME directory URL of the CA client is registered with
+func (c *Client) ServerURL() string {
+	return c.serverURL
+}
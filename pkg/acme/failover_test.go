@@ -0,0 +1,78 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// domainsError is shaped like error lego returns when obtaining certificate for domains fails
+type domainsError map[string]error
+
+func (e domainsError) Error() string {
+	return "error: one or more domains had a problem"
+}
+
+func TestShouldFailover(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "rate limited",
+			err:      fmt.Errorf("obtaining: %w", &legoacme.ProblemDetails{Type: errRateLimited, HTTPStatus: 429}),
+			expected: true,
+		},
+		{
+			name:     "server internal",
+			err:      &legoacme.ProblemDetails{Type: errServerInternal, HTTPStatus: 500},
+			expected: true,
+		},
+		{
+			name:     "service unavailable",
+			err:      &legoacme.ProblemDetails{HTTPStatus: 503},
+			expected: true,
+		},
+		{
+			name:     "network error",
+			err:      fmt.Errorf("posting: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			expected: true,
+		},
+		{
+			name: "failed finalization",
+			err: fmt.Errorf("obtaining: %w", domainsError{
+				"example.com":     &legoacme.ProblemDetails{Type: errRateLimited, HTTPStatus: 429},
+				"www.example.com": &legoacme.ProblemDetails{Type: errRateLimited, HTTPStatus: 429},
+			}),
+			expected: true,
+		},
+		{
+			name: "failed authorization",
+			err: domainsError{
+				"example.com": &legoacme.ProblemDetails{Type: "urn:ietf:params:acme:error:unauthorized",
+					HTTPStatus: 403},
+			},
+		},
+		{
+			name: "rejected identifier",
+			err:  &legoacme.ProblemDetails{Type: "urn:ietf:params:acme:error:rejectedIdentifier", HTTPStatus: 400},
+		},
+		{
+			name: "unauthorized",
+			err:  &legoacme.ProblemDetails{Type: "urn:ietf:params:acme:error:unauthorized", HTTPStatus: 403},
+		},
+		{
+			name: "other error",
+			err:  errors.New("DNS challenge provider is not configured"),
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, ShouldFailover(tcase.err))
+		})
+	}
+}
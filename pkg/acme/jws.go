@@ -0,0 +1,67 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// staticNonce provides a single nonce to jose signer
+type staticNonce string
+
+// Nonce implements jose.NonceSource interface
+func (n staticNonce) Nonce() (string, error) {
+	return string(n), nil
+}
+
+// signJWS signs payload the same way lego does for ACME requests.
+// If kid is empty, public key is embedded into JWS header instead of key identifier.
+// Empty nonce is omitted from header.
+func signJWS(key crypto.PrivateKey, kid, url, nonce string, payload []byte) (*jose.JSONWebSignature, error) {
+	alg, err := signatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	options := jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{
+			"url": url,
+		},
+	}
+	if nonce != "" {
+		options.NonceSource = staticNonce(nonce)
+	}
+	if kid == "" {
+		options.EmbedJWK = true
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+	}, &options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jose signer: %w", err)
+	}
+
+	return signer.Sign(payload)
+}
+
+func signatureAlgorithm(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported account key type %T", key)
+}
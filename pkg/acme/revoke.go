@@ -0,0 +1,74 @@
+package acme
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// revocationReasons maps RFC 5280 section 5.3.1 reason names to reason codes
+var revocationReasons = map[string]uint{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"removeFromCRL":        8,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+// ParseRevocationReason converts RFC 5280 reason name (e.g. keyCompromise) or code to reason code
+func ParseRevocationReason(reason string) (uint, error) {
+	if code, ok := revocationReasons[reason]; ok {
+		return code, nil
+	}
+
+	code, err := strconv.ParseUint(reason, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unknown revocation reason %q", reason)
+	}
+	for _, c := range revocationReasons {
+		if uint(code) == c {
+			return c, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown revocation reason code %d", code)
+}
+
+// Revoke revokes PEM encoded certificate with RFC 5280 reason code.
+// Request is signed with account key, or with certificate private key if certKey is not nil.
+func (c *Client) Revoke(cert []byte, reason uint, certKey crypto.PrivateKey) error {
+	certificates, err := certcrypto.ParsePEMBundle(cert)
+	if err != nil {
+		return err
+	}
+
+	x509Cert := certificates[0]
+	if x509Cert.IsCA {
+		return errors.New("certificate bundle starts with a CA certificate")
+	}
+
+	kid, key := c.user.GetRegistration().URI, c.user.GetPrivateKey()
+	if certKey != nil {
+		kid, key = "", certKey
+	}
+
+	core, err := c.newCore(kid, key)
+	if err != nil {
+		return err
+	}
+
+	return core.Certificates.Revoke(legoacme.RevokeCertMessage{
+		Certificate: base64.RawURLEncoding.EncodeToString(x509Cert.Raw),
+		Reason:      &reason,
+	})
+}
@@ -0,0 +1,33 @@
+package acme
+
+import (
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	for _, tcase := range []struct {
+		reason       string
+		expectedCode uint
+		expectedErr  bool
+	}{
+		{reason: "unspecified", expectedCode: 0},
+		{reason: "keyCompromise", expectedCode: 1},
+		{reason: "superseded", expectedCode: 4},
+		{reason: "5", expectedCode: 5},
+		{reason: "7", expectedErr: true},
+		{reason: "compromised", expectedErr: true},
+		{reason: "-1", expectedErr: true},
+	} {
+		t.Run(tcase.reason, func(t *testing.T) {
+			code, err := ParseRevocationReason(tcase.reason)
+			if tcase.expectedErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedCode, code)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/vault"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const accountDoesNotExistErr = "urn:ietf:params:acme:error:accountDoesNotExist"
+
+// RolloverKey replaces account key with a newly generated one.
+// The new key is stored in Vault as pending before CA is asked to change the key,
+// so that rollover interrupted after CA has accepted the new key is completed
+// on the next client setup.
+func (c *Client) RolloverKey(vault *vault.VaultClient) error {
+	if c.directory.KeyChangeURL == "" {
+		return errors.New("CA does not support account key rollover")
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	newKeyEncoded := certcrypto.PEMEncode(newKey)
+
+	c.logger.Info("saving pending ACME account key")
+	err = vault.KVWrite(c.accountPath+"key_rollover", map[string]string{"pem": string(newKeyEncoded)})
+	if err != nil {
+		return err
+	}
+
+	if err := c.keyChange(newKey); err != nil {
+		return fmt.Errorf("failed changing account key: %w", err)
+	}
+	c.logger.Info("account key changed at CA")
+
+	if err := completeKeyRollover(c.accountPath, c.user, newKey, newKeyEncoded, vault, c.logger); err != nil {
+		return err
+	}
+
+	// lego client signs requests with the key it was created with
+	c.Client, err = setupClient(c.user, c.serverURL, c.httpClient, c.logger)
+
+	return err
+}
+
+// keyChange asks CA to replace account key, see RFC 8555 section 7.3.5
+func (c *Client) keyChange(newKey crypto.PrivateKey) error {
+	accountURL := c.user.GetRegistration().URI
+	oldKey := jose.JSONWebKey{Key: c.user.GetPrivateKey()}
+
+	inner, err := json.Marshal(struct {
+		Account string          `json:"account"`
+		OldKey  jose.JSONWebKey `json:"oldKey"`
+	}{
+		Account: accountURL,
+		OldKey:  oldKey.Public(),
+	})
+	if err != nil {
+		return err
+	}
+
+	innerJWS, err := signJWS(newKey, "", c.directory.KeyChangeURL, "", inner)
+	if err != nil {
+		return err
+	}
+
+	return c.postJWS(c.directory.KeyChangeURL, func(nonce string) (*jose.JSONWebSignature, error) {
+		return signJWS(c.user.GetPrivateKey(), accountURL, c.directory.KeyChangeURL, nonce,
+			[]byte(innerJWS.FullSerialize()))
+	})
+}
+
+// postJWS posts request signed by sign to ACME server.
+// Request is retried once if server rejects the nonce.
+func (c *Client) postJWS(url string, sign func(nonce string) (*jose.JSONWebSignature, error)) error {
+	nonce, err := c.newNonce()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		signed, err := sign(nonce)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.httpClient.Post(url, "application/jose+json", strings.NewReader(signed.FullSerialize()))
+		if err != nil {
+			return err
+		}
+		// Body is closed before the request is retried, not when all attempts are done
+		problem, err := readProblem(resp, url)
+		resp.Body.Close()
+		if err != nil || problem == nil {
+			return err
+		}
+
+		if problem.Type == legoacme.BadNonceErr && attempt == 0 {
+			nonce = resp.Header.Get("Replay-Nonce")
+			continue
+		}
+
+		return problem
+	}
+}
+
+// readProblem decodes problem of ACME response to POST request, nil is returned if request succeeded
+func readProblem(resp *http.Response, url string) (*legoacme.ProblemDetails, error) {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil, nil
+	}
+
+	problem := &legoacme.ProblemDetails{}
+	if err := json.NewDecoder(resp.Body).Decode(problem); err != nil {
+		return nil, fmt.Errorf("%s :: %s :: %w", resp.Status, url, err)
+	}
+	problem.Method = http.MethodPost
+	problem.URL = url
+
+	return problem, nil
+}
+
+func (c *Client) newNonce() (string, error) {
+	resp, err := c.httpClient.Head(c.directory.NewNonceURL)
+	if err != nil {
+		return "", fmt.Errorf("failed getting nonce: %w", err)
+	}
+	defer resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("server did not respond with a nonce")
+	}
+
+	return nonce, nil
+}
+
+// recoverKeyRollover finishes or discards account key rollover that was interrupted.
+// If CA knows the pending key, it replaces account key in Vault, otherwise pending key is deleted.
+func recoverKeyRollover(path string, acc *User, httpClient *http.Client, serverURL string,
+	vault *vault.VaultClient, logger *logrus.Logger) error {
+	secrets, err := vault.KVRead(path + "key_rollover")
+	if err != nil {
+		return err
+	}
+	if secrets == nil {
+		return nil
+	}
+
+	keyEncoded, ok := secrets["pem"].(string)
+	if !ok {
+		return errors.New("pending key read from vault cannot be used")
+	}
+	pendingKey, err := certcrypto.ParsePEMPrivateKey([]byte(keyEncoded))
+	if err != nil {
+		return err
+	}
+
+	core, err := api.New(httpClient, "", serverURL, "", pendingKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = core.Accounts.New(legoacme.Account{OnlyReturnExisting: true})
+	var problem *legoacme.ProblemDetails
+	if errors.As(err, &problem) && problem.Type == accountDoesNotExistErr {
+		logger.Warn("CA does not know pending account key, discarding it")
+		return vault.KVDelete(path + "key_rollover")
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Warn("account key rollover was interrupted, completing it")
+	return completeKeyRollover(path, acc, pendingKey, []byte(keyEncoded), vault, logger)
+}
+
+func completeKeyRollover(path string, acc *User, key crypto.PrivateKey, keyEncoded []byte,
+	vault *vault.VaultClient, logger *logrus.Logger) error {
+	if err := saveKey(path, keyEncoded, vault, logger); err != nil {
+		return err
+	}
+	acc.key = key
+
+	return vault.KVDelete(path + "key_rollover")
+}
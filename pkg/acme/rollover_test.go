@@ -0,0 +1,97 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/sirupsen/logrus"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestKeyChange(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	var (
+		srvURL     string
+		nonces     int
+		badNonces  int
+		keyChanges int
+	)
+
+	smux := http.NewServeMux()
+	smux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		nonces++
+		w.Header().Set("Replay-Nonce", "first")
+	})
+	smux.HandleFunc("/key-change", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		testutil.Ok(t, err)
+
+		outer, err := jose.ParseSigned(string(body))
+		testutil.Ok(t, err)
+
+		// Server rejects the first nonce to check that request is retried
+		if outer.Signatures[0].Protected.Nonce == "first" {
+			badNonces++
+			w.Header().Set("Replay-Nonce", "second")
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:badNonce", "status": 400}`))
+			return
+		}
+		keyChanges++
+
+		testutil.Equals(t, srvURL+"/account/1", outer.Signatures[0].Protected.KeyID)
+		testutil.Equals(t, srvURL+"/key-change", outer.Signatures[0].Protected.ExtraHeaders["url"])
+		innerPayload, err := outer.Verify(oldKey.Public())
+		testutil.Ok(t, err)
+
+		inner, err := jose.ParseSigned(string(innerPayload))
+		testutil.Ok(t, err)
+		testutil.Assert(t, inner.Signatures[0].Protected.JSONWebKey != nil, "inner JWS should embed new key")
+		testutil.Equals(t, "", inner.Signatures[0].Protected.Nonce)
+		payload, err := inner.Verify(newKey.Public())
+		testutil.Ok(t, err)
+
+		var keyChange struct {
+			Account string          `json:"account"`
+			OldKey  jose.JSONWebKey `json:"oldKey"`
+		}
+		testutil.Ok(t, json.Unmarshal(payload, &keyChange))
+		testutil.Equals(t, srvURL+"/account/1", keyChange.Account)
+		testutil.Equals(t, oldKey.Public(), keyChange.OldKey.Key)
+	})
+
+	srv := httptest.NewServer(smux)
+	t.Cleanup(srv.Close)
+	srvURL = srv.URL
+
+	client := &Client{
+		user: &User{
+			Registration: &registration.Resource{URI: srv.URL + "/account/1"},
+			key:          oldKey,
+		},
+		directory: directory{
+			NewNonceURL:  srv.URL + "/new-nonce",
+			KeyChangeURL: srv.URL + "/key-change",
+		},
+		httpClient: srv.Client(),
+		logger:     logrus.New(),
+	}
+
+	testutil.Ok(t, client.keyChange(newKey))
+	testutil.Equals(t, 1, nonces)
+	testutil.Equals(t, 1, badNonces)
+	testutil.Equals(t, 1, keyChanges)
+}
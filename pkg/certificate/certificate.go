@@ -1,71 +1,273 @@
 package certificate
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-acme/lego/certcrypto"
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/challenge/dns01"
-	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/acme"
 	"github.com/vinted/certificator/pkg/vault"
 )
 
-// ObtainCertificate gets certificate and stores it in Vault KV store
-func ObtainCertificate(client *lego.Client, vault *vault.VaultClient, domains []string,
-	dnsAddr, challengeProvider string, propagationReq bool) error {
-	provider, err := dns.NewDNSChallengeProviderByName(challengeProvider)
-	if err != nil {
-		return err
+// keyTypes maps key type names used in configuration to lego key types
+var keyTypes = map[string]certcrypto.KeyType{
+	"EC256":   certcrypto.EC256,
+	"EC384":   certcrypto.EC384,
+	"RSA2048": certcrypto.RSA2048,
+	"RSA4096": certcrypto.RSA4096,
+}
+
+// ParseKeyType converts key type name (EC256, EC384, RSA2048 or RSA4096) to lego key type
+func ParseKeyType(name string) (certcrypto.KeyType, error) {
+	keyType, ok := keyTypes[name]
+	if !ok {
+		return "", fmt.Errorf("unsupported key type %q", name)
 	}
 
-	if propagationReq {
-		err = client.Challenge.SetDNS01Provider(provider,
-			dns01.AddRecursiveNameservers([]string{dnsAddr}))
-	} else {
-		err = client.Challenge.SetDNS01Provider(provider,
-			dns01.AddRecursiveNameservers([]string{dnsAddr}),
-			dns01.DisableCompletePropagationRequirement())
+	return keyType, nil
+}
+
+// Request describes a certificate that should be obtained
+type Request struct {
+	// Domains are certificate domains, the first one is used for CommonName
+	Domains []string
+	// VaultPath is location of certificate secret in Vault KV storage,
+	// VaultCertLocation of the first domain is used if it is empty
+	VaultPath string
+	KeyType   certcrypto.KeyType
+	// PreferredChain is common name of the issuer of the top certificate in the chain
+	// that is stored as the main one
+	PreferredChain string
+	// StoreAlternateChains enables storing all other chains CA offers
+	StoreAlternateChains bool
+	// Replaces is ARI identifier of the certificate the order replaces
+	Replaces string
+	// VaultVersion is version of certificate secret read before the order, see ReadCertificate.
+	// Certificate is stored only if the secret was not changed since then, so that concurrent runs
+	// do not overwrite each other. Secret is overwritten unconditionally if it is nil
+	VaultVersion *int
+	Challenge    Challenge
+}
+
+// location returns location of certificate secret in Vault KV storage
+func (r Request) location() string {
+	if r.VaultPath != "" {
+		return r.VaultPath
+	}
+
+	return VaultCertLocation(r.Domains[0])
+}
+
+// ObtainCertificate gets certificate and stores it in Vault KV store.
+// Domain control is proved by solving the configured challenge.
+func ObtainCertificate(client *acme.Client, vault *vault.VaultClient, req Request, logger *logrus.Entry) error {
+	if err := setChallengeProvider(client, vault, req.Challenge, req.Domains); err != nil {
+		return err
 	}
+
+	privateKey, err := certcrypto.GeneratePrivateKey(req.KeyType)
 	if err != nil {
 		return err
 	}
 
 	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
+		Domains:        req.Domains,
+		Bundle:         true,
+		PrivateKey:     privateKey,
+		PreferredChain: req.PreferredChain,
 	}
-	certificate, err := client.Certificate.Obtain(request)
+	certificate, err := client.Obtain(request, req.Replaces)
 	if err != nil {
 		return err
 	}
 
-	return storeCertificateInVault(domains[0], certificate, vault)
+	// Certificate is already issued, so it is stored even if its alternate chains can not be
+	var chainFields map[string]string
+	if req.StoreAlternateChains {
+		chainFields, err = alternateChainFields(client, certificate)
+		if err != nil {
+			logger.Warnf("certificate for %s is stored without alternate chains: %v", req.Domains[0], err)
+		}
+	}
+
+	return storeCertificateInVault(req.location(), certificate, chainFields, client.ServerURL(),
+		req.VaultVersion, vault, logger)
 }
 
-// GetCertificate reads certificate from Vault KV store and parses it
-func GetCertificate(domain string, vault *vault.VaultClient) (*x509.Certificate, error) {
-	secrets, err := vault.KVRead(vaultCertLocation(domain))
+// alternateChainFields returns secret fields with alternate chains CA offers for certificate
+// and common names of their issuers
+func alternateChainFields(client *acme.Client, certRes *certificate.Resource) (map[string]string, error) {
+	chains, err := client.AlternateChains(certRes)
 	if err != nil {
 		return nil, err
 	}
+
+	fields := make(map[string]string, 2*len(chains))
+	for i, chain := range chains {
+		issuer, err := chainIssuer(chain)
+		if err != nil {
+			return nil, err
+		}
+
+		field := fmt.Sprintf("alternate_chain_%d", i+1)
+		fields[field] = string(chain)
+		fields[field+"_issuer"] = issuer
+	}
+
+	return fields, nil
+}
+
+// GetCertificate reads certificate stored in Vault KV store at location and parses it.
+// Revoked certificates are treated as missing, so that they are reissued
+func GetCertificate(location string, vault *vault.VaultClient) (*x509.Certificate, error) {
+	cert, _, err := GetCertificateVersion(location, vault)
+
+	return cert, err
+}
+
+// GetCertificateVersion reads certificate like GetCertificate and returns it along with
+// the current version of its secret, which is 0 if the secret does not exist or KV storage is not versioned
+func GetCertificateVersion(location string, vault *vault.VaultClient) (*x509.Certificate, int, error) {
+	stored, err := ReadCertificate(location, vault)
+
+	return stored.Certificate, stored.Version, err
+}
+
+// StoredCertificate is certificate stored in Vault KV store along with details of its secret
+type StoredCertificate struct {
+	// Certificate is nil if the secret does not exist or certificate was revoked
+	Certificate *x509.Certificate
+	// Version is the current version of the secret, 0 if it does not exist or KV storage is not versioned
+	Version int
+	// CAURL is ACME directory URL of the CA that issued certificate,
+	// empty for certificates stored before the CA was recorded
+	CAURL string
+}
+
+// ReadCertificate reads certificate like GetCertificate along with its secret version and CA,
+// all from a single read of the secret
+func ReadCertificate(location string, vault *vault.VaultClient) (StoredCertificate, error) {
+	secrets, version, err := vault.KVReadVersion(location)
+	if err != nil {
+		return StoredCertificate{}, err
+	}
+
+	stored := StoredCertificate{Version: version}
+	stored.CAURL, _ = secrets["ca_url"].(string)
+	if _, revoked := secrets["revoked_at"]; revoked {
+		return stored, nil
+	}
 	if cert, ok := secrets["certificate"].(string); ok {
 		parsedCert, err := certcrypto.ParsePEMBundle([]byte(cert))
 		if err != nil {
-			return nil, err
+			return StoredCertificate{}, err
 		}
-		return parsedCert[0], nil
+		stored.Certificate = parsedCert[0]
+	}
+
+	return stored, nil
+}
+
+// GetCertificateCA returns ACME directory URL of the CA that issued certificate stored in Vault KV store
+// at location. Empty string is returned for certificates stored before the CA was recorded
+func GetCertificateCA(location string, vault *vault.VaultClient) (string, error) {
+	secrets, err := vault.KVRead(location)
+	if err != nil {
+		return "", err
+	}
+	caURL, _ := secrets["ca_url"].(string)
+
+	return caURL, nil
+}
+
+// RevokeCertificate revokes certificate stored in Vault KV store at location with RFC 5280 reason code
+// and marks the entry as revoked. Revocation request is signed with account key,
+// or with certificate private key if useCertKey is true.
+func RevokeCertificate(client *acme.Client, vault *vault.VaultClient, location string,
+	reason uint, useCertKey bool) error {
+	secrets, version, err := vault.KVReadVersion(location)
+	if err != nil {
+		return err
+	}
+
+	cert, ok := secrets["certificate"].(string)
+	if !ok {
+		return fmt.Errorf("certificate not found in vault at %s", location)
+	}
+
+	var certKey crypto.PrivateKey
+	if useCertKey {
+		privateKey, ok := secrets["private_key"].(string)
+		if !ok {
+			return fmt.Errorf("private key not found in vault at %s", location)
+		}
+		certKey, err = certcrypto.ParsePEMPrivateKey([]byte(privateKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := client.Revoke([]byte(cert), reason, certKey); err != nil {
+		return err
+	}
+
+	if err := markRevoked(location, cert, reason, secrets, version, vault); err != nil {
+		return fmt.Errorf("certificate was revoked at CA, but not marked as revoked in vault at %s: %w",
+			location, err)
 	}
 
-	return nil, nil
+	return nil
+}
+
+// markRevokedAttempts is number of times revoked certificate is marked if its secret keeps changing
+const markRevokedAttempts = 3
+
+// markRevoked marks certificate secret read at version as revoked, so that certificate is reissued.
+// If the secret was changed since then, it is read again and marked if it still holds the revoked certificate
+func markRevoked(location, cert string, reason uint, secrets map[string]interface{}, version int,
+	vaultClient *vault.VaultClient) error {
+	for attempt := 1; ; attempt++ {
+		payload := make(map[string]string, len(secrets)+2)
+		for key, value := range secrets {
+			if value, ok := value.(string); ok {
+				payload[key] = value
+			}
+		}
+		payload["revoked_at"] = time.Now().UTC().Format(time.RFC3339)
+		payload["revocation_reason"] = strconv.FormatUint(uint64(reason), 10)
+
+		_, err := vaultClient.KVWriteCAS(location, payload, version)
+		if !errors.Is(err, vault.ErrVersionConflict) || attempt == markRevokedAttempts {
+			return err
+		}
+
+		if secrets, version, err = vaultClient.KVReadVersion(location); err != nil {
+			return err
+		}
+		// Revoked certificate was replaced meanwhile, there is nothing to mark
+		if stored, _ := secrets["certificate"].(string); stored != cert {
+			return nil
+		}
+	}
 }
 
-// NeedsReissuing checks if certificate domains and required domains match
-// and if certificate expiration date is earlier than configured in config.Cfg.RenewBeforeDays
-func NeedsReissuing(certificate *x509.Certificate, domains []string, days int, logger *logrus.Logger) (bool, error) {
+// NeedsReissuing checks if certificate domains and required domains match,
+// if certificate key matches required key type
+// and if certificate is within renewal window suggested by CA.
+// If CA provides no renewal information, it checks if certificate expiration date
+// is earlier than configured in config.Cfg.RenewBeforeDays
+func NeedsReissuing(certificate *x509.Certificate, domains []string, keyType certcrypto.KeyType,
+	renewalInfo *acme.RenewalInfo, days int, logger *logrus.Logger) (bool, error) {
 	if certificate == nil {
 		return true, nil
 	}
@@ -74,14 +276,34 @@ func NeedsReissuing(certificate *x509.Certificate, domains []string, days int, l
 		return true, fmt.Errorf("certificate bundle for %s starts with a CA certificate", domains[0])
 	}
 
-	// Check if all domains are in certificate DNS names
-	if !arraysEqual(domains, certificate.DNSNames) {
+	// Check if certificate DNS names are exactly the required domains
+	if !domainsEqual(domains, certificate.DNSNames) {
 		logger.Printf("certificate %s domains changed, it needs reissuing", domains[0])
 		logger.Printf("certificate domains: %v", certificate.DNSNames)
 		logger.Printf("required domains: %v", domains)
 		return true, nil
 	}
 
+	if !keyTypeMatches(certificate, keyType) {
+		logger.Printf("certificate %s key type changed, it needs reissuing", domains[0])
+		return true, nil
+	}
+
+	if renewalInfo != nil {
+		logger.Printf("CA suggests renewing certificate between %v and %v",
+			renewalInfo.SuggestedWindow.Start, renewalInfo.SuggestedWindow.End)
+		if renewalInfo.ExplanationURL != "" {
+			logger.Printf("renewal window explanation: %s", renewalInfo.ExplanationURL)
+		}
+
+		if renewalInfo.ShouldRenew(time.Now()) {
+			return true, nil
+		}
+
+		logger.Printf("certificate for %s does not need renewing", domains[0])
+		return false, nil
+	}
+
 	notAfter := int(time.Until(certificate.NotAfter).Hours() / 24.0)
 	logger.Printf("certificate is valid for %v more days", notAfter)
 	if notAfter > days {
@@ -93,13 +315,39 @@ func NeedsReissuing(certificate *x509.Certificate, domains []string, days int, l
 	return true, nil
 }
 
-func arraysEqual(array1 []string, array2 []string) bool {
-	if len(array1) != len(array2) {
+func keyTypeMatches(certificate *x509.Certificate, keyType certcrypto.KeyType) bool {
+	switch publicKey := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		switch keyType {
+		case certcrypto.RSA2048:
+			return publicKey.N.BitLen() == 2048
+		case certcrypto.RSA4096:
+			return publicKey.N.BitLen() == 4096
+		case certcrypto.RSA8192:
+			return publicKey.N.BitLen() == 8192
+		}
+	case *ecdsa.PublicKey:
+		switch keyType {
+		case certcrypto.EC256:
+			return publicKey.Curve == elliptic.P256()
+		case certcrypto.EC384:
+			return publicKey.Curve == elliptic.P384()
+		}
+	}
+
+	return false
+}
+
+// domainsEqual checks if both lists contain the same set of domains,
+// ignoring order, duplicates, letter case and trailing dots
+func domainsEqual(domains1 []string, domains2 []string) bool {
+	set1, set2 := domainSet(domains1), domainSet(domains2)
+	if len(set1) != len(set2) {
 		return false
 	}
 
-	for _, v := range array1 {
-		if !arrayContains(array2, v) {
+	for domain := range set1 {
+		if !set2[domain] {
 			return false
 		}
 	}
@@ -107,23 +355,92 @@ func arraysEqual(array1 []string, array2 []string) bool {
 	return true
 }
 
-func arrayContains(array []string, element string) bool {
-	for _, a := range array {
-		if a == element {
-			return true
-		}
+func domainSet(domains []string) map[string]bool {
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		set[strings.ToLower(strings.TrimSuffix(domain, "."))] = true
 	}
-	return false
+
+	return set
 }
 
-func vaultCertLocation(domain string) string {
-	return "certificates/" + domain
+// chainIssuer returns common name of the issuer of the top certificate in the chain
+func chainIssuer(chain []byte) (string, error) {
+	certs, err := certcrypto.ParsePEMBundle(chain)
+	if err != nil {
+		return "", err
+	}
+
+	return certs[len(certs)-1].Issuer.CommonName, nil
+}
+
+// VaultCertLocation returns default location of certificate secret in Vault KV storage,
+// wildcard domain is encoded, e.g. certificates/_wildcard.example.com
+func VaultCertLocation(domain string) string {
+	return "certificates/" + vault.EncodePathSegment(domain)
 }
 
-func storeCertificateInVault(domain string, certs *certificate.Resource, vault *vault.VaultClient) error {
+// storeCertificateInVault stores certificate with its key, chain and chainFields of alternate chains,
+// and sets secret custom metadata describing it. Secret is written with check-and-set if version is set
+func storeCertificateInVault(location string, certs *certificate.Resource, chainFields map[string]string,
+	caURL string, version *int, vault *vault.VaultClient, logger *logrus.Entry) error {
 	payload := map[string]string{"certificate": string(certs.Certificate),
 		"private_key":        string(certs.PrivateKey),
-		"issuer_certificate": string(certs.IssuerCertificate)}
+		"issuer_certificate": string(certs.IssuerCertificate),
+		"ca_url":             caURL}
+
+	for field, value := range chainFields {
+		payload[field] = value
+	}
+
+	parsedCerts, err := certcrypto.ParsePEMBundle(certs.Certificate)
+	if err != nil {
+		return err
+	}
 
-	return vault.KVWrite(vaultCertLocation(domain), payload)
+	if version == nil {
+		if err := vault.KVWrite(location, payload); err != nil {
+			return err
+		}
+	} else {
+		stored, err := writeCertificateCAS(location, payload, parsedCerts[0], *version, vault, logger)
+		if err != nil {
+			return fmt.Errorf("certificate for %s with serial %x was obtained, but not stored: %w", certs.Domain,
+				parsedCerts[0].SerialNumber, err)
+		}
+		if !stored {
+			return nil
+		}
+	}
+
+	storeCertificateMetadata(location, parsedCerts[0], caURL, vault, logger)
+
+	return nil
+}
+
+// writeCertificateCAS writes certificate secret with check-and-set. If the secret was changed since
+// version was read, it is read again: certificate stored meanwhile, e.g. by a concurrent run, is kept if it
+// is valid for the same domains, otherwise the secret is written once more. Returns false if cert was not stored
+func writeCertificateCAS(location string, payload map[string]string, cert *x509.Certificate, version int,
+	vaultClient *vault.VaultClient, logger *logrus.Entry) (bool, error) {
+	_, err := vaultClient.KVWriteCAS(location, payload, version)
+	if !errors.Is(err, vault.ErrVersionConflict) {
+		return err == nil, err
+	}
+
+	secrets, version, err := vaultClient.KVReadVersion(location)
+	if err != nil {
+		return false, err
+	}
+	if _, err := checkRestorable(secrets, cert.DNSNames, time.Now()); err == nil {
+		logger.Warnf("certificate for %s was stored by another run meanwhile, obtained certificate with serial %x "+
+			"was not stored and can be revoked", cert.DNSNames[0], cert.SerialNumber)
+		return false, nil
+	}
+
+	if _, err := vaultClient.KVWriteCAS(location, payload, version); err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
@@ -1,15 +1,25 @@
 package certificate
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/sirupsen/logrus"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/vinted/certificator/pkg/acme"
+	"github.com/vinted/certificator/pkg/vault"
 )
 
 func TestNeedsReissuing(t *testing.T) {
@@ -22,12 +32,20 @@ func TestNeedsReissuing(t *testing.T) {
 	}
 	logger := logrus.New()
 
-	certificate := generateCert(t, template)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	testutil.Ok(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	certificate := generateCert(t, template, rsaKey)
+	ecCertificate := generateCert(t, template, ecKey)
 
 	for _, tcase := range []struct {
 		tcaseName       string
 		requiredDomains []string
 		certificate     *x509.Certificate
+		keyType         certcrypto.KeyType
+		renewalInfo     *acme.RenewalInfo
 		renewDays       int
 		expectedResult  bool
 	}{
@@ -35,6 +53,7 @@ func TestNeedsReissuing(t *testing.T) {
 			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, required domains correct",
 			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
 			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
 			renewDays:       30,
 			expectedResult:  false,
 		},
@@ -42,6 +61,7 @@ func TestNeedsReissuing(t *testing.T) {
 			tcaseName:       "certificate expires after three months (90 days), renewDays = 100, required domains correct",
 			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
 			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
 			renewDays:       100,
 			expectedResult:  true,
 		},
@@ -49,6 +69,7 @@ func TestNeedsReissuing(t *testing.T) {
 			tcaseName:       "nil certificate, renew days 30, required domains correct",
 			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
 			certificate:     nil,
+			keyType:         certcrypto.RSA2048,
 			renewDays:       30,
 			expectedResult:  true,
 		},
@@ -56,6 +77,7 @@ func TestNeedsReissuing(t *testing.T) {
 			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, fewer required domains than certificate has",
 			requiredDomains: []string{"www.test.com", "*.test.com"},
 			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
 			renewDays:       30,
 			expectedResult:  true,
 		},
@@ -63,6 +85,7 @@ func TestNeedsReissuing(t *testing.T) {
 			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, more required domains than certificate has",
 			requiredDomains: []string{"test.com", "www.test.com", "*.test.com", "additional.test.com"},
 			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
 			renewDays:       30,
 			expectedResult:  true,
 		},
@@ -70,23 +93,138 @@ func TestNeedsReissuing(t *testing.T) {
 			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, different required domains than certificate has",
 			requiredDomains: []string{"test.com", "www.test.com", "different.test.com"},
 			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewDays:       30,
+			expectedResult:  true,
+		},
+		{
+			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, required domains in different order and case",
+			requiredDomains: []string{"*.test.com", "WWW.test.com.", "test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewDays:       30,
+			expectedResult:  false,
+		},
+		{
+			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, duplicate required domain instead of a missing one",
+			requiredDomains: []string{"test.com", "test.com", "*.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewDays:       30,
+			expectedResult:  true,
+		},
+		{
+			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, duplicate required domain",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com", "www.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewDays:       30,
+			expectedResult:  false,
+		},
+		{
+			tcaseName:       "RSA 2048 certificate, EC256 key type required",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.EC256,
+			renewDays:       30,
+			expectedResult:  true,
+		},
+		{
+			tcaseName:       "RSA 2048 certificate, RSA4096 key type required",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA4096,
+			renewDays:       30,
+			expectedResult:  true,
+		},
+		{
+			tcaseName:       "EC256 certificate, EC256 key type required",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
+			certificate:     ecCertificate,
+			keyType:         certcrypto.EC256,
+			renewDays:       30,
+			expectedResult:  false,
+		},
+		{
+			tcaseName:       "EC256 certificate, EC384 key type required",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
+			certificate:     ecCertificate,
+			keyType:         certcrypto.EC384,
+			renewDays:       30,
+			expectedResult:  true,
+		},
+		{
+			tcaseName:       "certificate expires after three months (90 days), renewDays = 30, CA suggests renewing now",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewalInfo:     renewalWindow(time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)),
+			renewDays:       30,
+			expectedResult:  true,
+		},
+		{
+			tcaseName:       "certificate expires after three months (90 days), renewDays = 100, CA suggests renewing later",
+			requiredDomains: []string{"test.com", "www.test.com", "*.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewalInfo:     renewalWindow(time.Now().AddDate(0, 2, 0), time.Now().AddDate(0, 2, 2)),
+			renewDays:       100,
+			expectedResult:  false,
+		},
+		{
+			tcaseName:       "CA suggests renewing later, required domains changed",
+			requiredDomains: []string{"test.com", "www.test.com", "different.test.com"},
+			certificate:     certificate,
+			keyType:         certcrypto.RSA2048,
+			renewalInfo:     renewalWindow(time.Now().AddDate(0, 2, 0), time.Now().AddDate(0, 2, 2)),
 			renewDays:       30,
 			expectedResult:  true,
 		},
 	} {
 		t.Run(tcase.tcaseName, func(t *testing.T) {
-			result, err := NeedsReissuing(tcase.certificate, tcase.requiredDomains, tcase.renewDays, logger)
+			result, err := NeedsReissuing(tcase.certificate, tcase.requiredDomains, tcase.keyType,
+				tcase.renewalInfo, tcase.renewDays, logger)
 			testutil.Ok(t, err)
 			testutil.Equals(t, tcase.expectedResult, result)
 		})
 	}
 }
 
-func generateCert(t *testing.T, template *x509.Certificate) *x509.Certificate {
-	privatekey, err := rsa.GenerateKey(rand.Reader, 512)
-	testutil.Ok(t, err)
+func TestParseKeyType(t *testing.T) {
+	for _, tcase := range []struct {
+		name            string
+		expectedKeyType certcrypto.KeyType
+		expectedErr     bool
+	}{
+		{name: "EC256", expectedKeyType: certcrypto.EC256},
+		{name: "EC384", expectedKeyType: certcrypto.EC384},
+		{name: "RSA2048", expectedKeyType: certcrypto.RSA2048},
+		{name: "RSA4096", expectedKeyType: certcrypto.RSA4096},
+		{name: "P256", expectedErr: true},
+		{name: "", expectedErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			keyType, err := ParseKeyType(tcase.name)
+			if tcase.expectedErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedKeyType, keyType)
+		})
+	}
+}
 
-	publickey := &privatekey.PublicKey
+func renewalWindow(start, end time.Time) *acme.RenewalInfo {
+	info := &acme.RenewalInfo{}
+	info.SuggestedWindow.Start = start
+	info.SuggestedWindow.End = end
+
+	return info
+}
+
+func generateCert(t *testing.T, template *x509.Certificate, privatekey crypto.Signer) *x509.Certificate {
+	publickey := privatekey.Public()
 
 	// create a self-signed certificate. template = parent
 	var parent = template
@@ -97,3 +235,76 @@ func generateCert(t *testing.T, template *x509.Certificate) *x509.Certificate {
 
 	return parsedCert
 }
+
+// setenv sets environment variable for the duration of test
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	os.Setenv(key, value)
+}
+
+func TestMarkRevoked(t *testing.T) {
+	for _, tcase := range []struct {
+		name          string
+		storedCert    string
+		expectedMarks int
+	}{
+		{name: "secret changed meanwhile", storedCert: "revoked", expectedMarks: 2},
+		{name: "certificate replaced meanwhile", storedCert: "reissued", expectedMarks: 1},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var marks int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/v1/sys/internal/ui/mounts/kv/certificator":
+					_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+						"path": "kv/", "type": "kv", "options": map[string]interface{}{"version": "2"},
+					}})
+				case r.URL.Path == "/v1/kv/data/certificator/certificates/test.com" && r.Method == http.MethodGet:
+					_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+						"data":     map[string]interface{}{"certificate": tcase.storedCert, "private_key": "key"},
+						"metadata": map[string]interface{}{"version": 2},
+					}})
+				case r.URL.Path == "/v1/kv/data/certificator/certificates/test.com" && r.Method == http.MethodPut:
+					marks++
+					var payload struct {
+						Data    map[string]string `json:"data"`
+						Options struct {
+							CAS int `json:"cas"`
+						} `json:"options"`
+					}
+					testutil.Ok(t, json.NewDecoder(r.Body).Decode(&payload))
+					testutil.Equals(t, "revoked", payload.Data["certificate"])
+					testutil.Equals(t, "1", payload.Data["revocation_reason"])
+					// Secret was changed since version 1 was read
+					if payload.Options.CAS != 2 {
+						w.WriteHeader(http.StatusBadRequest)
+						_, _ = w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+						return
+					}
+					_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": 3}})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+			setenv(t, "VAULT_ADDR", srv.URL)
+
+			vaultClient, err := vault.NewVaultClientWithAuth(vault.Auth{Method: vault.AuthToken, Token: "token"},
+				"kv/certificator/", logrus.New())
+			testutil.Ok(t, err)
+			defer vaultClient.Close()
+
+			secrets := map[string]interface{}{"certificate": "revoked", "private_key": "key"}
+			testutil.Ok(t, markRevoked("certificates/test.com", "revoked", 1, secrets, 1, vaultClient))
+			testutil.Equals(t, tcase.expectedMarks, marks)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package certificate
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/providers/http/webroot"
+	"github.com/vinted/certificator/pkg/acme"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// Supported challenge types
+const (
+	ChallengeDNS01     = "dns-01"
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// Challenge contains configuration of ACME challenge used to prove control over domains
+type Challenge struct {
+	// Type is one of supported challenge types, dns-01 is used if it is empty
+	Type string
+
+	// DNSAddresses are DNS resolvers used to check challenge DNS record propagation, tried in order
+	DNSAddresses []string
+	// DNSProvider solves challenges of domains that are not in zones of DNSProviders
+	DNSProvider DNSProvider
+	// DNSProviders solve challenges of domains in their zones
+	DNSProviders              []DNSProvider
+	DNSPropagationRequirement bool
+	// DNSAuthoritativeCheck enables checking challenge record only at authoritative nameservers of its zone
+	DNSAuthoritativeCheck bool
+	// DNSTiming is used for providers that do not set their own timing
+	DNSTiming DNSTiming
+
+	// HTTPAddress is address built-in HTTP-01 challenge server listens on
+	HTTPAddress string
+	// HTTPWebroot is a directory HTTP-01 challenge tokens are written to instead of serving them.
+	// Built-in server is used if it is empty
+	HTTPWebroot string
+
+	// TLSALPNAddress is address built-in TLS-ALPN-01 challenge server listens on
+	TLSALPNAddress string
+}
+
+// setChallengeProvider configures client to solve only the given challenge for domains
+func setChallengeProvider(client *acme.Client, vault *vault.VaultClient, chlg Challenge, domains []string) error {
+	for _, chlgType := range []challenge.Type{challenge.DNS01, challenge.HTTP01, challenge.TLSALPN01} {
+		client.Challenge.Remove(chlgType)
+	}
+
+	switch chlg.Type {
+	case "", ChallengeDNS01:
+		provider, err := newDNSProvider(vault, chlg, domains)
+		if err != nil {
+			return err
+		}
+
+		return client.Challenge.SetDNS01Provider(provider,
+			dns01.AddRecursiveNameservers(chlg.DNSAddresses),
+			dns01.CondOption(!chlg.DNSPropagationRequirement, dns01.DisableCompletePropagationRequirement()),
+			dns01.CondOption(chlg.DNSAuthoritativeCheck, dns01.WrapPreCheck(authoritativePreCheck(chlg.DNSAddresses))))
+	case ChallengeHTTP01:
+		if chlg.HTTPWebroot != "" {
+			provider, err := webroot.NewHTTPProvider(chlg.HTTPWebroot)
+			if err != nil {
+				return err
+			}
+			return client.Challenge.SetHTTP01Provider(provider)
+		}
+
+		iface, port, err := net.SplitHostPort(chlg.HTTPAddress)
+		if err != nil {
+			return fmt.Errorf("invalid HTTP-01 challenge server address: %w", err)
+		}
+		return client.Challenge.SetHTTP01Provider(http01.NewProviderServer(iface, port))
+	case ChallengeTLSALPN01:
+		iface, port, err := net.SplitHostPort(chlg.TLSALPNAddress)
+		if err != nil {
+			return fmt.Errorf("invalid TLS-ALPN-01 challenge server address: %w", err)
+		}
+		return client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer(iface, port))
+	default:
+		return fmt.Errorf("unsupported challenge type %q", chlg.Type)
+	}
+}
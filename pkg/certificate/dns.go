@@ -0,0 +1,278 @@
+package certificate
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/providers/dns"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// DNSProvider is lego DNS challenge provider with its settings
+type DNSProvider struct {
+	// Provider is lego DNS challenge provider name
+	Provider string
+	// Zones are DNS zones served by the provider, challenges of domains in these zones
+	// and their subdomains are solved by it
+	Zones []string
+	// Settings are provider environment variables, e.g. AWS_REGION,
+	// they override process environment while the provider is created
+	Settings map[string]string
+	// VaultPath is location of provider credentials in Vault KV storage.
+	// If it is set, provider is configured only with settings and credentials,
+	// which are keyed by lego environment variable names
+	VaultPath string
+	// Timing overrides provider TTL, propagation timeout and polling interval
+	Timing DNSTiming
+}
+
+// DNSTiming contains DNS challenge record TTL and propagation check timing, zero values are not applied
+type DNSTiming struct {
+	// TTL is challenge TXT record TTL in seconds
+	TTL                int
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+}
+
+// withDefaults returns timing with values that are not set taken from defaults
+func (t DNSTiming) withDefaults(defaults DNSTiming) DNSTiming {
+	if t.TTL == 0 {
+		t.TTL = defaults.TTL
+	}
+	if t.PropagationTimeout == 0 {
+		t.PropagationTimeout = defaults.PropagationTimeout
+	}
+	if t.PollingInterval == 0 {
+		t.PollingInterval = defaults.PollingInterval
+	}
+
+	return t
+}
+
+// dnsEnvPrefixes are lego environment variable prefixes of providers whose prefix is not their uppercase name
+var dnsEnvPrefixes = map[string]string{
+	"alidns":       "ALICLOUD",
+	"digitalocean": "DO",
+	"gcloud":       "GCE",
+	"route53":      "AWS",
+}
+
+// dnsEnvPrefix returns prefix of lego environment variables of provider, e.g. CLOUDFLARE
+func dnsEnvPrefix(provider string) string {
+	if prefix, ok := dnsEnvPrefixes[provider]; ok {
+		return prefix
+	}
+
+	return strings.ToUpper(strings.ReplaceAll(provider, "-", "_"))
+}
+
+// dnsProviderIndex returns index of provider serving the longest zone domain belongs to,
+// -1 is returned if domain is not in any of the zones
+func dnsProviderIndex(providers []DNSProvider, domain string) int {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+
+	index, longest := -1, 0
+	for i, provider := range providers {
+		for _, zone := range provider.Zones {
+			zone = strings.ToLower(dns01.UnFqdn(zone))
+			if (domain == zone || strings.HasSuffix(domain, "."+zone)) && len(zone) > longest {
+				index, longest = i, len(zone)
+			}
+		}
+	}
+
+	return index
+}
+
+// newDNSProvider creates challenge provider for domains.
+// Every domain is served by provider of its zone or the default one, if it is not in any of the zones.
+// If domains span several providers, challenges are dispatched to them by domain
+func newDNSProvider(vault *vault.VaultClient, chlg Challenge, domains []string) (challenge.Provider, error) {
+	created := make(map[int]challenge.Provider)
+	dispatcher := dnsDispatcher{providers: make(map[string]challenge.Provider, len(domains))}
+
+	for _, domain := range domains {
+		index := dnsProviderIndex(chlg.DNSProviders, domain)
+
+		provider, ok := created[index]
+		if !ok {
+			config := chlg.DNSProvider
+			if index >= 0 {
+				config = chlg.DNSProviders[index]
+			}
+			config.Timing = config.Timing.withDefaults(chlg.DNSTiming)
+
+			var err error
+			provider, err = createDNSProvider(vault, config)
+			if err != nil {
+				return nil, fmt.Errorf("creating DNS challenge provider for %s: %w", domain, err)
+			}
+			created[index] = provider
+		}
+
+		dispatcher.providers[strings.ToLower(strings.TrimPrefix(domain, "*."))] = provider
+	}
+
+	if len(created) == 1 {
+		for _, provider := range created {
+			return provider, nil
+		}
+	}
+
+	return dispatcher, nil
+}
+
+// createDNSProvider creates lego DNS challenge provider with environment overridden by its settings,
+// or with settings and credentials read from Vault, if credentials location is set.
+// Timing overrides TTL setting and propagation timing of the provider
+func createDNSProvider(vault *vault.VaultClient, config DNSProvider) (challenge.Provider, error) {
+	if config.Provider == "" {
+		return nil, fmt.Errorf("DNS challenge provider is not configured")
+	}
+
+	if config.Timing.TTL > 0 {
+		settings := make(map[string]string, len(config.Settings)+1)
+		for key, value := range config.Settings {
+			settings[key] = value
+		}
+		settings[dnsEnvPrefix(config.Provider)+"_TTL"] = strconv.Itoa(config.Timing.TTL)
+		config.Settings = settings
+	}
+
+	provider, err := createConfiguredDNSProvider(vault, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Timing.PropagationTimeout > 0 || config.Timing.PollingInterval > 0 {
+		return timedDNSProvider{Provider: provider, timing: config.Timing}, nil
+	}
+
+	return provider, nil
+}
+
+func createConfiguredDNSProvider(vault *vault.VaultClient, config DNSProvider) (challenge.Provider, error) {
+	if config.VaultPath != "" {
+		// Credentials are read on every run, so that rotated ones are picked up
+		secrets, err := vault.KVRead(config.VaultPath)
+		if err != nil {
+			return nil, err
+		}
+		if secrets == nil {
+			return nil, fmt.Errorf("DNS challenge provider credentials not found in vault at %s", config.VaultPath)
+		}
+
+		values := make(dnsValues, len(config.Settings)+len(secrets))
+		for key, value := range config.Settings {
+			values[key] = value
+		}
+		for key, value := range secrets {
+			if value, ok := value.(string); ok {
+				values[key] = value
+			}
+		}
+
+		return createDNSProviderFromConfig(config.Provider, values)
+	}
+
+	restore := make(map[string]*string, len(config.Settings))
+	for key, value := range config.Settings {
+		if previous, ok := os.LookupEnv(key); ok {
+			restore[key] = &previous
+		} else {
+			restore[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+	defer func() {
+		for key, value := range restore {
+			if value != nil {
+				os.Setenv(key, *value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}()
+
+	return dns.NewDNSChallengeProviderByName(config.Provider)
+}
+
+// timedDNSProvider overrides propagation timeout and polling interval of provider
+type timedDNSProvider struct {
+	challenge.Provider
+	timing DNSTiming
+}
+
+// Timeout returns configured propagation timeout and polling interval, or the ones of provider if they are not set
+func (p timedDNSProvider) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if provider, ok := p.Provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = provider.Timeout()
+	}
+
+	if p.timing.PropagationTimeout > 0 {
+		timeout = p.timing.PropagationTimeout
+	}
+	if p.timing.PollingInterval > 0 {
+		interval = p.timing.PollingInterval
+	}
+
+	return timeout, interval
+}
+
+// dnsDispatcher solves DNS-01 challenges of every domain with provider serving its zone
+type dnsDispatcher struct {
+	providers map[string]challenge.Provider
+}
+
+func (d dnsDispatcher) provider(domain string) (challenge.Provider, error) {
+	provider, ok := d.providers[strings.ToLower(domain)]
+	if !ok {
+		return nil, fmt.Errorf("no DNS challenge provider for %s", domain)
+	}
+
+	return provider, nil
+}
+
+// Present creates TXT record with provider serving domain zone
+func (d dnsDispatcher) Present(domain, token, keyAuth string) error {
+	provider, err := d.provider(domain)
+	if err != nil {
+		return err
+	}
+
+	return provider.Present(domain, token, keyAuth)
+}
+
+// CleanUp removes TXT record with provider serving domain zone
+func (d dnsDispatcher) CleanUp(domain, token, keyAuth string) error {
+	provider, err := d.provider(domain)
+	if err != nil {
+		return err
+	}
+
+	return provider.CleanUp(domain, token, keyAuth)
+}
+
+// Timeout returns the longest propagation timeout and polling interval of providers
+func (d dnsDispatcher) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	for _, provider := range d.providers {
+		if provider, ok := provider.(challenge.ProviderTimeout); ok {
+			providerTimeout, providerInterval := provider.Timeout()
+			if providerTimeout > timeout {
+				timeout = providerTimeout
+			}
+			if providerInterval > interval {
+				interval = providerInterval
+			}
+		}
+	}
+
+	return timeout, interval
+}
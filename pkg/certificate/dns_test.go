@@ -0,0 +1,160 @@
+package certificate
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDNSProviderIndex(t *testing.T) {
+	providers := []DNSProvider{
+		{Provider: "route53", Zones: []string{"example.com", "example.org."}},
+		{Provider: "rfc2136", Zones: []string{"internal.example.com"}},
+	}
+
+	for _, tcase := range []struct {
+		domain   string
+		expected int
+	}{
+		{domain: "example.com", expected: 0},
+		{domain: "www.example.com", expected: 0},
+		{domain: "*.example.org", expected: 0},
+		{domain: "WWW.Example.ORG", expected: 0},
+		{domain: "internal.example.com", expected: 1},
+		{domain: "host.internal.example.com", expected: 1},
+		{domain: "*.internal.example.com", expected: 1},
+		{domain: "notexample.com", expected: -1},
+		{domain: "example.net", expected: -1},
+	} {
+		t.Run(tcase.domain, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, dnsProviderIndex(providers, tcase.domain))
+		})
+	}
+}
+
+type fakeDNSProvider struct {
+	present  []string
+	cleanUp  []string
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func (p *fakeDNSProvider) Present(domain, token, keyAuth string) error {
+	p.present = append(p.present, domain)
+	return nil
+}
+
+func (p *fakeDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	p.cleanUp = append(p.cleanUp, domain)
+	return nil
+}
+
+func (p *fakeDNSProvider) Timeout() (timeout, interval time.Duration) {
+	return p.timeout, p.interval
+}
+
+func TestDNSDispatcher(t *testing.T) {
+	providerA := &fakeDNSProvider{timeout: 10 * time.Minute, interval: time.Second}
+	providerB := &fakeDNSProvider{timeout: time.Minute, interval: 10 * time.Second}
+	dispatcher := dnsDispatcher{providers: map[string]challenge.Provider{
+		"a.com":     providerA,
+		"www.a.com": providerA,
+		"b.com":     providerB,
+	}}
+
+	for _, domain := range []string{"a.com", "b.com", "www.a.com"} {
+		testutil.Ok(t, dispatcher.Present(domain, "token", "keyAuth"))
+		testutil.Ok(t, dispatcher.CleanUp(domain, "token", "keyAuth"))
+	}
+	testutil.NotOk(t, dispatcher.Present("c.com", "token", "keyAuth"))
+
+	testutil.Equals(t, []string{"a.com", "www.a.com"}, providerA.present)
+	testutil.Equals(t, []string{"a.com", "www.a.com"}, providerA.cleanUp)
+	testutil.Equals(t, []string{"b.com"}, providerB.present)
+	testutil.Equals(t, []string{"b.com"}, providerB.cleanUp)
+
+	timeout, interval := dispatcher.Timeout()
+	testutil.Equals(t, 10*time.Minute, timeout)
+	testutil.Equals(t, 10*time.Second, interval)
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	os.Setenv("EXEC_PATH", "/default")
+	defer os.Unsetenv("EXEC_PATH")
+
+	defaultProvider := DNSProvider{Provider: "exec"}
+	providers := []DNSProvider{
+		{Provider: "exec", Zones: []string{"a.com"}, Settings: map[string]string{"EXEC_PATH": "/a"}},
+		{Provider: "exec", Zones: []string{"b.com"}, Settings: map[string]string{"EXEC_PATH": "/b"}},
+	}
+
+	provider, err := newDNSProvider(nil, Challenge{DNSProvider: defaultProvider, DNSProviders: providers},
+		[]string{"a.com", "*.a.com"})
+	testutil.Ok(t, err)
+	_, isDispatcher := provider.(dnsDispatcher)
+	testutil.Assert(t, !isDispatcher, "domains of a single provider should not be dispatched")
+
+	provider, err = newDNSProvider(nil, Challenge{DNSProvider: defaultProvider, DNSProviders: providers},
+		[]string{"a.com", "*.b.com", "c.com"})
+	testutil.Ok(t, err)
+	dispatcher, isDispatcher := provider.(dnsDispatcher)
+	testutil.Assert(t, isDispatcher, "domains of several providers should be dispatched")
+	testutil.Equals(t, 3, len(dispatcher.providers))
+	testutil.Assert(t, dispatcher.providers["a.com"] != dispatcher.providers["b.com"],
+		"zones should be served by different providers")
+
+	// Settings do not leak to the environment
+	testutil.Equals(t, "/default", os.Getenv("EXEC_PATH"))
+
+	_, err = newDNSProvider(nil, Challenge{DNSProviders: providers}, []string{"c.com"})
+	testutil.NotOk(t, err)
+}
+
+func TestDNSProviderTiming(t *testing.T) {
+	os.Setenv("EXEC_PATH", "/default")
+	defer os.Unsetenv("EXEC_PATH")
+
+	chlg := Challenge{
+		DNSProvider: DNSProvider{Provider: "exec"},
+		DNSProviders: []DNSProvider{{
+			Provider: "exec",
+			Zones:    []string{"a.com"},
+			Timing:   DNSTiming{PropagationTimeout: 5 * time.Minute},
+		}},
+		DNSTiming: DNSTiming{PropagationTimeout: time.Minute, PollingInterval: 7 * time.Second},
+	}
+
+	for _, tcase := range []struct {
+		domain           string
+		expectedTimeout  time.Duration
+		expectedInterval time.Duration
+	}{
+		// Provider timing overrides global one
+		{domain: "a.com", expectedTimeout: 5 * time.Minute, expectedInterval: 7 * time.Second},
+		{domain: "b.com", expectedTimeout: time.Minute, expectedInterval: 7 * time.Second},
+	} {
+		t.Run(tcase.domain, func(t *testing.T) {
+			provider, err := newDNSProvider(nil, chlg, []string{tcase.domain})
+			testutil.Ok(t, err)
+
+			timeout, interval := provider.(challenge.ProviderTimeout).Timeout()
+			testutil.Equals(t, tcase.expectedTimeout, timeout)
+			testutil.Equals(t, tcase.expectedInterval, interval)
+		})
+	}
+
+	// Provider timing is kept if no timing is configured
+	provider, err := newDNSProvider(nil, Challenge{DNSProvider: DNSProvider{Provider: "exec"}}, []string{"b.com"})
+	testutil.Ok(t, err)
+	_, isTimed := provider.(timedDNSProvider)
+	testutil.Assert(t, !isTimed, "provider without configured timing should not be wrapped")
+}
+
+func TestDNSEnvPrefix(t *testing.T) {
+	testutil.Equals(t, "CLOUDFLARE", dnsEnvPrefix("cloudflare"))
+	testutil.Equals(t, "AWS", dnsEnvPrefix("route53"))
+	testutil.Equals(t, "DO", dnsEnvPrefix("digitalocean"))
+}
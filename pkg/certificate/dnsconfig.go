@@ -0,0 +1,162 @@
+package certificate
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/exec"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	legoRoute53 "github.com/go-acme/lego/v4/providers/dns/route53"
+)
+
+// dnsConfigBuilders create DNS challenge providers from lego config structs.
+// Providers are configured only with the given values, which use lego environment variable names as keys,
+// so that credentials are not taken from process environment
+var dnsConfigBuilders = map[string]func(values dnsValues) (challenge.Provider, error){
+	"cloudflare": newCloudflareProvider,
+	"exec":       newExecProvider,
+	"rfc2136":    newRFC2136Provider,
+	"route53":    newRoute53Provider,
+}
+
+// createDNSProviderFromConfig creates DNS challenge provider configured only with values
+func createDNSProviderFromConfig(provider string, values dnsValues) (challenge.Provider, error) {
+	builder, ok := dnsConfigBuilders[provider]
+	if !ok {
+		supported := make([]string, 0, len(dnsConfigBuilders))
+		for name := range dnsConfigBuilders {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+
+		return nil, fmt.Errorf("DNS challenge provider %s does not support credentials from Vault, supported providers: %v",
+			provider, supported)
+	}
+
+	return builder(values)
+}
+
+// dnsValues are DNS challenge provider settings keyed by lego environment variable names
+type dnsValues map[string]string
+
+func (v dnsValues) string(key, fallback string) string {
+	if value, ok := v[key]; ok {
+		return value
+	}
+
+	return fallback
+}
+
+func (v dnsValues) int(key string, fallback int) (int, error) {
+	value, ok := v[key]
+	if !ok {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q: %w", key, value, err)
+	}
+
+	return parsed, nil
+}
+
+// seconds parses value in seconds the same way lego does for environment variables
+func (v dnsValues) seconds(key string, fallback time.Duration) (time.Duration, error) {
+	seconds, err := v.int(key, int(fallback/time.Second))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// timing sets TTL, propagation timeout and polling interval from values with the given prefix
+func (v dnsValues) timing(prefix string, ttl *int, timeout, interval *time.Duration) error {
+	var err error
+	if ttl != nil {
+		if *ttl, err = v.int(prefix+"TTL", *ttl); err != nil {
+			return err
+		}
+	}
+	if *timeout, err = v.seconds(prefix+"PROPAGATION_TIMEOUT", *timeout); err != nil {
+		return err
+	}
+	*interval, err = v.seconds(prefix+"POLLING_INTERVAL", *interval)
+
+	return err
+}
+
+func newCloudflareProvider(values dnsValues) (challenge.Provider, error) {
+	config := cloudflare.NewDefaultConfig()
+	config.AuthEmail = values.string("CLOUDFLARE_EMAIL", "")
+	config.AuthKey = values.string("CLOUDFLARE_API_KEY", "")
+	config.AuthToken = values.string("CLOUDFLARE_DNS_API_TOKEN", "")
+	config.ZoneToken = values.string("CLOUDFLARE_ZONE_API_TOKEN", config.AuthToken)
+	if err := values.timing("CLOUDFLARE_", &config.TTL, &config.PropagationTimeout,
+		&config.PollingInterval); err != nil {
+		return nil, err
+	}
+
+	return cloudflare.NewDNSProviderConfig(config)
+}
+
+func newExecProvider(values dnsValues) (challenge.Provider, error) {
+	config := exec.NewDefaultConfig()
+	config.Program = values.string(exec.EnvPath, "")
+	config.Mode = values.string(exec.EnvMode, "")
+	if err := values.timing("EXEC_", nil, &config.PropagationTimeout, &config.PollingInterval); err != nil {
+		return nil, err
+	}
+
+	return exec.NewDNSProviderConfig(config)
+}
+
+func newRFC2136Provider(values dnsValues) (challenge.Provider, error) {
+	config := rfc2136.NewDefaultConfig()
+	config.Nameserver = values.string(rfc2136.EnvNameserver, "")
+	config.TSIGAlgorithm = values.string(rfc2136.EnvTSIGAlgorithm, config.TSIGAlgorithm)
+	config.TSIGKey = values.string(rfc2136.EnvTSIGKey, "")
+	config.TSIGSecret = values.string(rfc2136.EnvTSIGSecret, "")
+	if err := values.timing("RFC2136_", &config.TTL, &config.PropagationTimeout,
+		&config.PollingInterval); err != nil {
+		return nil, err
+	}
+
+	return rfc2136.NewDNSProviderConfig(config)
+}
+
+func newRoute53Provider(values dnsValues) (challenge.Provider, error) {
+	config := legoRoute53.NewDefaultConfig()
+	config.HostedZoneID = values.string(legoRoute53.EnvHostedZoneID, "")
+	if err := values.timing("AWS_", &config.TTL, &config.PropagationTimeout,
+		&config.PollingInterval); err != nil {
+		return nil, err
+	}
+
+	awsConfig := aws.NewConfig().WithMaxRetries(config.MaxRetries)
+	if region := values.string(legoRoute53.EnvRegion, ""); region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	// Without static credentials session falls back to shared credentials file or instance role
+	if accessKeyID := values.string(legoRoute53.EnvAccessKeyID, ""); accessKeyID != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(accessKeyID,
+			values.string(legoRoute53.EnvSecretAccessKey, ""), values.string("AWS_SESSION_TOKEN", "")))
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	config.Client = route53.New(sess)
+
+	return legoRoute53.NewDNSProviderConfig(config)
+}
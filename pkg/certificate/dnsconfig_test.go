@@ -0,0 +1,86 @@
+package certificate
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCreateDNSProviderFromConfig(t *testing.T) {
+	// Process environment must not be used by providers created from config
+	os.Setenv("RFC2136_NAMESERVER", "127.0.0.1")
+	defer os.Unsetenv("RFC2136_NAMESERVER")
+
+	for _, tcase := range []struct {
+		name     string
+		provider string
+		values   dnsValues
+		timeout  time.Duration
+		interval time.Duration
+		err      bool
+	}{
+		{
+			name:     "exec",
+			provider: "exec",
+			values:   dnsValues{"EXEC_PATH": "/update-dns.sh", "EXEC_PROPAGATION_TIMEOUT": "120"},
+			timeout:  2 * time.Minute,
+			interval: 2 * time.Second,
+		},
+		{
+			name:     "cloudflare",
+			provider: "cloudflare",
+			values:   dnsValues{"CLOUDFLARE_DNS_API_TOKEN": "token", "CLOUDFLARE_POLLING_INTERVAL": "5"},
+			timeout:  2 * time.Minute,
+			interval: 5 * time.Second,
+		},
+		{
+			name:     "rfc2136",
+			provider: "rfc2136",
+			values:   dnsValues{"RFC2136_NAMESERVER": "10.0.0.53", "RFC2136_TSIG_KEY": "key", "RFC2136_TSIG_SECRET": "c2VjcmV0"},
+			timeout:  time.Minute,
+			interval: 2 * time.Second,
+		},
+		{
+			name:     "rfc2136 without nameserver",
+			provider: "rfc2136",
+			values:   dnsValues{"RFC2136_TSIG_KEY": "key"},
+			err:      true,
+		},
+		{
+			name:     "route53",
+			provider: "route53",
+			values: dnsValues{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_REGION": "eu-west-1", "AWS_TTL": "60"},
+			timeout:  2 * time.Minute,
+			interval: 4 * time.Second,
+		},
+		{
+			name:     "invalid timeout",
+			provider: "exec",
+			values:   dnsValues{"EXEC_PATH": "/update-dns.sh", "EXEC_PROPAGATION_TIMEOUT": "2m"},
+			err:      true,
+		},
+		{
+			name:     "unsupported provider",
+			provider: "gandi",
+			values:   dnsValues{"GANDI_API_KEY": "key"},
+			err:      true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			provider, err := createDNSProviderFromConfig(tcase.provider, tcase.values)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+
+			timeout, interval := provider.(challenge.ProviderTimeout).Timeout()
+			testutil.Equals(t, tcase.timeout, timeout)
+			testutil.Equals(t, tcase.interval, interval)
+		})
+	}
+}
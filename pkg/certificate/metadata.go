@@ -0,0 +1,92 @@
+package certificate
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/vault"
+	"github.com/vinted/certificator/pkg/version"
+)
+
+// maxMetadataValue is the longest custom metadata value Vault accepts
+const maxMetadataValue = 512
+
+// storeCertificateMetadata sets custom metadata of certificate secret, so that certificates can be inventoried
+// without reading their private keys. Metadata is informational, so failure to write it is only logged,
+// e.g. Vault older than 1.9 or a policy without access to metadata path must not fail stored certificates
+func storeCertificateMetadata(location string, cert *x509.Certificate, caURL string, vault *vault.VaultClient,
+	logger *logrus.Entry) {
+	if err := vault.KVWriteMetadata(location, certificateMetadata(cert, caURL)); err != nil {
+		logger.Warnf("certificate for %s was stored, but its metadata was not: %v", cert.DNSNames[0], err)
+	}
+}
+
+// certificateMetadata describes certificate with Vault custom metadata values.
+// SANs that do not fit into a single value are continued in sans_2, sans_3, etc.
+func certificateMetadata(cert *x509.Certificate, caURL string) map[string]string {
+	fingerprint := sha256.Sum256(cert.Raw)
+	metadata := map[string]string{
+		"serial":               fmt.Sprintf("%x", cert.SerialNumber),
+		"not_before":           cert.NotBefore.UTC().Format(time.RFC3339),
+		"not_after":            cert.NotAfter.UTC().Format(time.RFC3339),
+		"issuer":               cert.Issuer.String(),
+		"key_type":             certificateKeyType(cert),
+		"fingerprint_sha256":   fmt.Sprintf("%x", fingerprint),
+		"ca_url":               caURL,
+		"certificator_version": version.Version,
+	}
+
+	for i, sans := range splitList(cert.DNSNames, maxMetadataValue) {
+		key := "sans"
+		if i > 0 {
+			key += "_" + strconv.Itoa(i+1)
+		}
+		metadata[key] = sans
+	}
+
+	return metadata
+}
+
+// certificateKeyType returns key type name of certificate public key, e.g. EC256, or unknown
+func certificateKeyType(cert *x509.Certificate) string {
+	names := make([]string, 0, len(keyTypes))
+	for name := range keyTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if keyTypeMatches(cert, keyTypes[name]) {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// splitList joins items with commas into values of at most limit bytes
+func splitList(items []string, limit int) []string {
+	var values []string
+	var value strings.Builder
+	for _, item := range items {
+		if value.Len() > 0 && value.Len()+1+len(item) > limit {
+			values = append(values, value.String())
+			value.Reset()
+		}
+		if value.Len() > 0 {
+			value.WriteString(",")
+		}
+		value.WriteString(item)
+	}
+	if value.Len() > 0 {
+		values = append(values, value.String())
+	}
+
+	return values
+}
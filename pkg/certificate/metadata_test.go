@@ -0,0 +1,63 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/vinted/certificator/pkg/version"
+)
+
+func TestCertificateMetadata(t *testing.T) {
+	notBefore := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0xabcdef),
+		Subject:      pkix.Name{CommonName: "Test CA"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.AddDate(0, 3, 0),
+		DNSNames:     []string{"test.com", "*.test.com"},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	testutil.Ok(t, err)
+	cert := generateCert(t, template, key)
+
+	testutil.Equals(t, map[string]string{
+		"serial":               "abcdef",
+		"not_before":           "2021-06-01T12:00:00Z",
+		"not_after":            "2021-09-01T12:00:00Z",
+		"issuer":               "CN=Test CA",
+		"sans":                 "test.com,*.test.com",
+		"key_type":             "EC384",
+		"fingerprint_sha256":   fmt.Sprintf("%x", sha256.Sum256(cert.Raw)),
+		"ca_url":               "https://acme.example.com/directory",
+		"certificator_version": version.Version,
+	}, certificateMetadata(cert, "https://acme.example.com/directory"))
+}
+
+func TestSplitList(t *testing.T) {
+	long := strings.Repeat("a", 60) + ".com"
+
+	for _, tcase := range []struct {
+		name     string
+		items    []string
+		expected []string
+	}{
+		{name: "empty"},
+		{name: "single value", items: []string{"a.com", "b.com"}, expected: []string{"a.com,b.com"}},
+		{name: "exactly fits", items: []string{long, long}, expected: []string{long + "," + long}},
+		{name: "split", items: []string{long, long, "a.com"}, expected: []string{long + "," + long, "a.com"}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, splitList(tcase.items, 2*len(long)+1))
+		})
+	}
+}
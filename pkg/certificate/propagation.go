@@ -0,0 +1,171 @@
+package certificate
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// nameserverPort is port authoritative nameservers are queried on
+var nameserverPort = "53"
+
+const dnsQueryTimeout = 10 * time.Second
+
+// authoritativePreCheck returns DNS-01 challenge check that looks for TXT record only at authoritative
+// nameservers of the record zone. Zone and its nameservers are looked up with resolvers, but the record itself
+// is not queried through them, so that their caches and split horizon views do not delay the check.
+// Nameserver addresses are looked up with resolvers too, as system resolver may not know them
+func authoritativePreCheck(resolvers []string) dns01.WrapPreCheckFunc {
+	resolvers = dns01.ParseNameservers(resolvers)
+
+	return func(domain, fqdn, value string, _ dns01.PreCheckFunc) (bool, error) {
+		zone, err := dns01.FindZoneByFqdnCustom(fqdn, resolvers)
+		if err != nil {
+			return false, fmt.Errorf("could not determine zone of %s: %w", fqdn, err)
+		}
+
+		nameservers, err := zoneNameservers(zone, resolvers)
+		if err != nil {
+			return false, err
+		}
+
+		for _, ns := range nameservers {
+			addresses, err := nameserverAddresses(ns, resolvers)
+			if err != nil {
+				return false, err
+			}
+
+			// Any address of nameserver that responds is enough
+			var records []string
+			for _, address := range addresses {
+				if records, err = txtRecords(fqdn, net.JoinHostPort(address, nameserverPort)); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				return false, err
+			}
+			if !contains(records, value) {
+				return false, fmt.Errorf("NS %s did not return the expected TXT record [fqdn: %s, value: %s]: %s",
+					ns, fqdn, value, strings.Join(records, " ,"))
+			}
+		}
+
+		return true, nil
+	}
+}
+
+// zoneNameservers returns NS records of zone, resolvers are tried in order
+func zoneNameservers(zone string, resolvers []string) ([]string, error) {
+	var lastErr error
+	for _, resolver := range resolvers {
+		in, err := dnsExchange(zone, dns.TypeNS, resolver, true)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var nameservers []string
+		for _, rr := range in.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				nameservers = append(nameservers, strings.ToLower(dns01.UnFqdn(ns.Ns)))
+			}
+		}
+		if len(nameservers) > 0 {
+			return nameservers, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("could not determine authoritative nameservers of %s: %w", zone, lastErr)
+	}
+	return nil, fmt.Errorf("could not determine authoritative nameservers of %s", zone)
+}
+
+// nameserverAddresses returns IPv4 and IPv6 addresses of nameserver host, resolvers are tried in order
+func nameserverAddresses(host string, resolvers []string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	var lastErr error
+	for _, resolver := range resolvers {
+		var addresses []string
+		for _, rtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			in, err := dnsExchange(host, rtype, resolver, true)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			for _, rr := range in.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					addresses = append(addresses, rr.A.String())
+				case *dns.AAAA:
+					addresses = append(addresses, rr.AAAA.String())
+				}
+			}
+		}
+		if len(addresses) > 0 {
+			return addresses, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("could not determine addresses of NS %s: %w", host, lastErr)
+	}
+	return nil, fmt.Errorf("could not determine addresses of NS %s", host)
+}
+
+// txtRecords queries nameserver for TXT records of fqdn without recursion
+func txtRecords(fqdn, nameserver string) ([]string, error) {
+	in, err := dnsExchange(fqdn, dns.TypeTXT, nameserver, false)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("NS %s returned %s for %s", nameserver, dns.RcodeToString[in.Rcode], fqdn)
+	}
+
+	var records []string
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			records = append(records, strings.Join(txt.Txt, ""))
+		}
+	}
+
+	return records, nil
+}
+
+// dnsExchange sends DNS query over UDP, it is retried over TCP if response is truncated
+func dnsExchange(name string, rtype uint16, nameserver string, recursive bool) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), rtype)
+	m.SetEdns0(4096, false)
+	m.RecursionDesired = recursive
+
+	in, _, err := (&dns.Client{Net: "udp", Timeout: dnsQueryTimeout}).Exchange(m, nameserver)
+	if in != nil && in.Truncated {
+		in, _, err = (&dns.Client{Net: "tcp", Timeout: dnsQueryTimeout}).Exchange(m, nameserver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying %s for %s: %w", nameserver, name, err)
+	}
+
+	return in, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
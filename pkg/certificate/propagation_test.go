@@ -0,0 +1,84 @@
+package certificate
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// startDNSServer serves SOA and NS records of example.com zone, address of its nameserver ns1.example.com
+// and TXT records of _acme-challenge.example.com. Recursive queries for the TXT record are answered with stale value, as a resolver with a different view would
+func startDNSServer(t *testing.T, txt string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Qtype == dns.TypeSOA && q.Name == "example.com.":
+			m.Answer = append(m.Answer, &dns.SOA{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "localhost.", Mbox: "hostmaster.example.com.",
+			})
+		case q.Qtype == dns.TypeSOA:
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "localhost.", Mbox: "hostmaster.example.com.",
+			})
+		case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns1.example.com.",
+			})
+		case q.Qtype == dns.TypeA && q.Name == "ns1.example.com.":
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			})
+		case q.Qtype == dns.TypeTXT && q.Name == "_acme-challenge.example.com.":
+			value := txt
+			if r.RecursionDesired {
+				value = "stale"
+			}
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return conn.LocalAddr().String()
+}
+
+func TestAuthoritativePreCheck(t *testing.T) {
+	address := startDNSServer(t, "value")
+	_, port, err := net.SplitHostPort(address)
+	testutil.Ok(t, err)
+
+	defaultPort := nameserverPort
+	nameserverPort = port
+	defer func() { nameserverPort = defaultPort }()
+
+	check := authoritativePreCheck([]string{"127.0.0.1:1", address})
+
+	found, err := check("example.com", "_acme-challenge.example.com.", "value", nil)
+	testutil.Ok(t, err)
+	testutil.Assert(t, found, "record should be found at authoritative nameserver")
+
+	found, err = check("example.com", "_acme-challenge.example.com.", "other", nil)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !found, "record with different value should not be found")
+}
@@ -0,0 +1,118 @@
+package certificate
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/sirupsen/logrus"
+	"github.com/vinted/certificator/pkg/vault"
+)
+
+// RollbackCertificate restores version of certificate secret stored in Vault KV v2 store at location,
+// by writing its data as the latest version. If version is 0, the latest not deleted version preceding
+// the current one is restored. Restored certificate must be issued for domains, not revoked nor expired
+// and match its private key. Restored version is returned
+func RollbackCertificate(location string, version int, domains []string, vault *vault.VaultClient,
+	logger *logrus.Entry) (int, error) {
+	versions, current, err := vault.KVVersions(location)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("certificate not found in vault at %s", location)
+	}
+
+	if version == 0 {
+		for _, v := range versions {
+			if v.Version < current && !v.Deleted && !v.Destroyed {
+				version = v.Version
+			}
+		}
+		if version == 0 {
+			return 0, fmt.Errorf("no previous version of %s to restore", location)
+		}
+	}
+	if version == current {
+		return 0, fmt.Errorf("version %d of %s is already the current one", version, location)
+	}
+
+	secrets, err := vault.KVReadAt(location, version)
+	if err != nil {
+		return 0, err
+	}
+	if secrets == nil {
+		return 0, fmt.Errorf("version %d of %s does not exist or is deleted", version, location)
+	}
+	cert, err := checkRestorable(secrets, domains, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("version %d of %s can not be restored: %w", version, location, err)
+	}
+
+	payload := make(map[string]string, len(secrets))
+	for key, value := range secrets {
+		if value, ok := value.(string); ok {
+			payload[key] = value
+		}
+	}
+	if _, err := vault.KVWriteCAS(location, payload, current); err != nil {
+		return 0, err
+	}
+
+	// Metadata is rewritten to describe the restored certificate instead of the replaced one
+	storeCertificateMetadata(location, cert, payload["ca_url"], vault, logger)
+
+	return version, nil
+}
+
+// checkRestorable checks that stored certificate secret can be used again at the given time
+// and returns its certificate
+func checkRestorable(secrets map[string]interface{}, domains []string, now time.Time) (*x509.Certificate, error) {
+	if revokedAt, ok := secrets["revoked_at"].(string); ok {
+		return nil, fmt.Errorf("certificate was revoked at %s", revokedAt)
+	}
+
+	certPEM, ok := secrets["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("certificate is missing")
+	}
+	certs, err := certcrypto.ParsePEMBundle([]byte(certPEM))
+	if err != nil {
+		return nil, err
+	}
+	cert := certs[0]
+
+	if cert.IsCA {
+		return nil, fmt.Errorf("certificate bundle starts with a CA certificate")
+	}
+	if !domainsEqual(domains, cert.DNSNames) {
+		return nil, fmt.Errorf("certificate domains %v do not match required domains %v", cert.DNSNames, domains)
+	}
+	if now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", cert.NotAfter)
+	}
+	if now.Before(cert.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid until %s", cert.NotBefore)
+	}
+
+	keyPEM, ok := secrets["private_key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("private key is missing")
+	}
+	privateKey, err := certcrypto.ParsePEMPrivateKey([]byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("private key does not match certificate")
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,100 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCheckRestorable(t *testing.T) {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 3, 0),
+		DNSNames:     []string{"test.com", "www.test.com"},
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	certPEM := string(certcrypto.PEMEncode(certcrypto.DERCertificateBytes(generateCert(t, template, key).Raw)))
+	keyPEM := string(certcrypto.PEMEncode(key))
+	otherKeyPEM := string(certcrypto.PEMEncode(otherKey))
+
+	for _, tcase := range []struct {
+		name    string
+		secrets map[string]interface{}
+		domains []string
+		now     time.Time
+		err     bool
+	}{
+		{
+			name:    "valid",
+			secrets: map[string]interface{}{"certificate": certPEM, "private_key": keyPEM},
+			domains: []string{"www.test.com", "test.com"},
+			now:     now,
+		},
+		{
+			name:    "revoked",
+			secrets: map[string]interface{}{"certificate": certPEM, "private_key": keyPEM, "revoked_at": "2021-01-01T00:00:00Z"},
+			domains: []string{"test.com", "www.test.com"},
+			now:     now,
+			err:     true,
+		},
+		{
+			name:    "other domains",
+			secrets: map[string]interface{}{"certificate": certPEM, "private_key": keyPEM},
+			domains: []string{"test.com"},
+			now:     now,
+			err:     true,
+		},
+		{
+			name:    "expired",
+			secrets: map[string]interface{}{"certificate": certPEM, "private_key": keyPEM},
+			domains: []string{"test.com", "www.test.com"},
+			now:     now.AddDate(1, 0, 0),
+			err:     true,
+		},
+		{
+			name:    "other private key",
+			secrets: map[string]interface{}{"certificate": certPEM, "private_key": otherKeyPEM},
+			domains: []string{"test.com", "www.test.com"},
+			now:     now,
+			err:     true,
+		},
+		{
+			name:    "missing private key",
+			secrets: map[string]interface{}{"certificate": certPEM},
+			domains: []string{"test.com", "www.test.com"},
+			now:     now,
+			err:     true,
+		},
+		{
+			name:    "missing certificate",
+			secrets: map[string]interface{}{"private_key": keyPEM},
+			domains: []string{"test.com", "www.test.com"},
+			now:     now,
+			err:     true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			cert, err := checkRestorable(tcase.secrets, tcase.domains, tcase.now)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, big.NewInt(1234), cert.SerialNumber)
+		})
+	}
+}
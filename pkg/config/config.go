@@ -1,68 +1,472 @@
 package config
 
 import (
-	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v2"
+	"github.com/vinted/certificator/pkg/vault"
 )
 
 // Acme contains acme related configuration parameters
 type Acme struct {
-	AccountEmail              string `envconfig:"ACME_ACCOUNT_EMAIL" required:"true"`
-	DNSChallengeProvider      string `envconfig:"ACME_DNS_CHALLENGE_PROVIDER" required:"true"`
-	DNSPropagationRequirement bool   `envconfig:"ACME_DNS_PROPAGATION_REQUIREMENT" default:"true"`
-	ReregisterAccount         bool   `envconfig:"ACME_REREGISTER_ACCOUNT" default:"false"`
-	ServerURL                 string `envconfig:"ACME_SERVER_URL" default:"https://acme-staging-v02.api.letsencrypt.org/directory"`
+	AccountEmail              string `envconfig:"ACME_ACCOUNT_EMAIL" yaml:"account_email"`
+	ChallengeType             string `envconfig:"ACME_CHALLENGE_TYPE" default:"dns-01" yaml:"challenge_type"`
+	DNSChallengeProvider      string `envconfig:"ACME_DNS_CHALLENGE_PROVIDER" yaml:"dns_challenge_provider"`
+	DNSCredentialsVaultPath   string `envconfig:"ACME_DNS_CHALLENGE_PROVIDER_VAULT_PATH" yaml:"dns_challenge_provider_vault_path"`
+	DNSPropagationRequirement bool   `envconfig:"ACME_DNS_PROPAGATION_REQUIREMENT" default:"true" yaml:"dns_propagation_requirement"`
+	DNSAuthoritativeCheck     bool   `envconfig:"ACME_DNS_AUTHORITATIVE_CHECK" default:"false" yaml:"dns_authoritative_check"`
+	DNSPropagationTimeout     int    `envconfig:"ACME_DNS_PROPAGATION_TIMEOUT" yaml:"dns_propagation_timeout"`
+	DNSPollingInterval        int    `envconfig:"ACME_DNS_POLLING_INTERVAL" yaml:"dns_polling_interval"`
+	DNSTTL                    int    `envconfig:"ACME_DNS_TTL" yaml:"dns_ttl"`
+	PreferredChain            string `envconfig:"ACME_PREFERRED_CHAIN" yaml:"preferred_chain"`
+	StoreAlternateChains      bool   `envconfig:"ACME_STORE_ALTERNATE_CHAINS" default:"false" yaml:"store_alternate_chains"`
+	EABKeyID                  string `envconfig:"ACME_EAB_KID" yaml:"eab_kid"`
+	EABHMACKey                string `envconfig:"ACME_EAB_HMAC_KEY" yaml:"eab_hmac_key" secret:"true"`
+	HTTP01Address             string `envconfig:"ACME_HTTP01_ADDRESS" default:":80" yaml:"http01_address"`
+	HTTP01Webroot             string `envconfig:"ACME_HTTP01_WEBROOT" yaml:"http01_webroot"`
+	TLSALPN01Address          string `envconfig:"ACME_TLSALPN01_ADDRESS" default:":443" yaml:"tlsalpn01_address"`
+	ReregisterAccount         bool   `envconfig:"ACME_REREGISTER_ACCOUNT" default:"false" yaml:"reregister_account"`
+	ServerURL                 string `envconfig:"ACME_SERVER_URL" default:"https://acme-staging-v02.api.letsencrypt.org/directory" yaml:"server_url"`
+	CAFailover                bool   `envconfig:"ACME_CA_FAILOVER" default:"true" yaml:"ca_failover"`
+}
+
+// CA is ACME certificate authority profile defined in config file.
+// Account email and registration option default to acme section values
+type CA struct {
+	Name              string `yaml:"name"`
+	ServerURL         string `yaml:"server_url"`
+	AccountEmail      string `yaml:"account_email"`
+	EABKeyID          string `yaml:"eab_kid"`
+	EABHMACKey        string `yaml:"eab_hmac_key" secret:"true"`
+	ReregisterAccount *bool  `yaml:"reregister_account"`
 }
 
 // Vault contains vault related configuration parameters
 type Vault struct {
-	ApproleRoleID   string `envconfig:"VAULT_APPROLE_ROLE_ID"`
-	ApproleSecretID string `envconfig:"VAULT_APPROLE_SECRET_ID"`
-	KVStoragePath   string `envconfig:"VAULT_KV_STORAGE_PATH" default:"secret/data/certificator/"`
+	// AuthMethod selects Vault authentication method, ENVIRONMENT decides it if empty
+	AuthMethod          string `envconfig:"VAULT_AUTH_METHOD" yaml:"auth_method"`
+	AuthMount           string `envconfig:"VAULT_AUTH_MOUNT" yaml:"auth_mount"`
+	Role                string `envconfig:"VAULT_ROLE" yaml:"role"`
+	Token               string `envconfig:"VAULT_TOKEN" yaml:"token" secret:"true"`
+	TokenFile           string `envconfig:"VAULT_TOKEN_FILE" yaml:"token_file"`
+	ApproleRoleID       string `envconfig:"VAULT_APPROLE_ROLE_ID" yaml:"approle_role_id"`
+	ApproleSecretID     string `envconfig:"VAULT_APPROLE_SECRET_ID" yaml:"approle_secret_id" secret:"true"`
+	JWT                 string `envconfig:"VAULT_JWT" yaml:"jwt" secret:"true"`
+	JWTFile             string `envconfig:"VAULT_JWT_FILE" yaml:"jwt_file"`
+	KubernetesTokenFile string `envconfig:"VAULT_KUBERNETES_TOKEN_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" yaml:"kubernetes_token_file"`
+	ClientCert          string `envconfig:"VAULT_CLIENT_CERT" yaml:"client_cert"`
+	ClientKey           string `envconfig:"VAULT_CLIENT_KEY" yaml:"client_key"`
+	Username            string `envconfig:"VAULT_USERNAME" yaml:"username"`
+	Password            string `envconfig:"VAULT_PASSWORD" yaml:"password" secret:"true"`
+	KVStoragePath       string `envconfig:"VAULT_KV_STORAGE_PATH" default:"secret/certificator/" yaml:"kv_storage_path"`
 }
 
 type Log struct {
-	Format string `envconfig:"LOG_FORMAT" default:"JSON"`
-	Level  string `envconfig:"LOG_LEVEL" default:"INFO"`
+	Format string `envconfig:"LOG_FORMAT" default:"JSON" yaml:"format"`
+	Level  string `envconfig:"LOG_LEVEL" default:"INFO" yaml:"level"`
+}
+
+// Domain is a single entry of domains file, every entry results in a certificate.
+// It can be defined either as a string of comma separated domains
+// or as an object with certificate options
+type Domain struct {
+	// Name is used for certificate CommonName and as a key in Vault
+	Name string `yaml:"name"`
+	// SANs are additional domains added using Subject Alternate Names extension
+	SANs []string `yaml:"sans"`
+	// Group is substituted into {group} placeholder of Vault path template
+	Group string `yaml:"group"`
+	// Options below override global configuration when set
+	// CA is name of preferred CA profile
+	CA        string `yaml:"ca"`
+	KeyType   string `yaml:"key_type"`
+	Challenge string `yaml:"challenge"`
+	// DNSProvider is name of provider defined in domains file or lego DNS challenge provider name,
+	// it solves challenges of all certificate domains
+	DNSProvider          string `yaml:"dns_provider"`
+	RenewBeforeDays      int    `yaml:"renew_before_days"`
+	VaultPath            string `yaml:"vault_path"`
+	VaultPathTemplate    string `yaml:"vault_path_template"`
+	PreferredChain       string `yaml:"preferred_chain"`
+	StoreAlternateChains *bool  `yaml:"store_alternate_chains"`
+	HTTP01Webroot        string `yaml:"http01_webroot"`
+	TLSALPN01Address     string `yaml:"tlsalpn01_address"`
+
+	// Source is domains file the entry is defined in
+	Source string `yaml:"-"`
+	// RawName is name as written in domains file before normalization.
+	// Versions before normalization used it as the key in Vault KV store
+	RawName string `yaml:"-"`
+	// nameErrors are errors of names that could not be normalized
+	nameErrors map[string]error
+}
+
+// UnmarshalYAML accepts both plain string and object entries.
+// Object entries may list domains in a comma separated `domains` string instead of name and sans.
+// Domain names are normalized, names that can not be normalized are kept for ValidateDomains to report
+func (d *Domain) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var domains string
+	if err := unmarshal(&domains); err == nil {
+		*d = Domain{}
+		d.setDomains(domains)
+		return d.validate()
+	}
+
+	type domain Domain
+	var entry struct {
+		domain  `yaml:",inline"`
+		Domains string `yaml:"domains"`
+	}
+	if err := unmarshal(&entry); err != nil {
+		return err
+	}
+
+	*d = Domain(entry.domain)
+	if entry.Domains != "" {
+		if d.Name != "" || len(d.SANs) > 0 {
+			return errors.Errorf("domains entry %q sets both domains and name or sans", entry.Domains)
+		}
+		d.setDomains(entry.Domains)
+	}
+
+	return d.validate()
+}
+
+// AllDomains returns certificate name followed by its SANs
+func (d Domain) AllDomains() []string {
+	return append([]string{d.Name}, d.SANs...)
+}
+
+func (d *Domain) setDomains(domains string) {
+	var names []string
+	for _, name := range strings.Split(domains, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) > 0 {
+		d.Name = names[0]
+	}
+	if len(names) > 1 {
+		d.SANs = names[1:]
+	}
+}
+
+func (d *Domain) validate() error {
+	if d.Name == "" {
+		return errors.New("domains entry has no name")
+	}
+	d.normalize()
+	if d.RenewBeforeDays < 0 {
+		return errors.Errorf("domains entry %s has negative renew_before_days", d.Name)
+	}
+	if d.VaultPath != "" && d.VaultPathTemplate != "" {
+		return errors.Errorf("domains entry %s sets both vault_path and vault_path_template", d.Name)
+	}
+
+	return nil
+}
+
+// DNSProvider is DNS challenge provider defined in domains file.
+// It solves challenges of domains in its zones, or of domains entries referring to it by name
+type DNSProvider struct {
+	Name     string            `yaml:"name"`
+	Provider string            `yaml:"provider"`
+	Zones    []string          `yaml:"zones"`
+	Settings map[string]string `yaml:"settings"`
+	// VaultPath is location of provider credentials in Vault KV storage
+	VaultPath string `yaml:"vault_path"`
+	// Options below are in seconds and override global configuration when set
+	PropagationTimeout int `yaml:"propagation_timeout"`
+	PollingInterval    int `yaml:"polling_interval"`
+	TTL                int `yaml:"ttl"`
+
+	// Source is domains file the provider is defined in
+	Source string `yaml:"-"`
+}
+
+// UnmarshalYAML checks that provider is defined and can be used
+func (p *DNSProvider) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type dnsProvider DNSProvider
+	if err := unmarshal((*dnsProvider)(p)); err != nil {
+		return err
+	}
+
+	if p.Provider == "" {
+		return errors.Errorf("dns provider %q has no provider set", p.Name)
+	}
+	if p.Name == "" && len(p.Zones) == 0 {
+		return errors.Errorf("dns provider %s has neither name nor zones", p.Provider)
+	}
+	if p.PropagationTimeout < 0 || p.PollingInterval < 0 || p.TTL < 0 {
+		return errors.Errorf("dns provider %s has negative timing option", p.Provider)
+	}
+
+	return nil
 }
 
 // Config contains all configuration parameters
 type Config struct {
-	Acme            Acme
-	Vault           Vault
-	Log             Log
-	DNSAddress      string   `envconfig:"DNS_ADDRESS" default:"127.0.0.1:53"`
-	Environment     string   `envconfig:"ENVIRONMENT" default:"prod"`
-	DomainsFile     string   `envconfig:"CERTIFICATOR_DOMAINS_FILE" default:"/code/domains.yml"`
-	RenewBeforeDays int      `envconfig:"CERTIFICATOR_RENEW_BEFORE_DAYS" default:"30"`
-	Domains         []string `yaml:"domains"`
-}
-
-// LoadConfig loads configuration options to  variable
-func LoadConfig() (Config, error) {
-	var cfg Config
-	err := envconfig.Process("", &cfg)
+	Acme              Acme          `yaml:"acme"`
+	Vault             Vault         `yaml:"vault"`
+	Log               Log           `yaml:"log"`
+	DNSAddresses      StringList    `envconfig:"DNS_ADDRESS" default:"127.0.0.1:53" yaml:"dns_address"`
+	Environment       string        `envconfig:"ENVIRONMENT" default:"prod" yaml:"environment"`
+	DomainsFile       string        `envconfig:"CERTIFICATOR_DOMAINS_FILE" default:"/code/domains.yml" yaml:"domains_file"`
+	KeyType           string        `envconfig:"CERTIFICATOR_KEY_TYPE" default:"RSA2048" yaml:"key_type"`
+	MaxSANs           int           `envconfig:"CERTIFICATOR_MAX_SANS" default:"100" yaml:"max_sans"`
+	RenewBeforeDays   int           `envconfig:"CERTIFICATOR_RENEW_BEFORE_DAYS" default:"30" yaml:"renew_before_days"`
+	VaultPathTemplate string        `envconfig:"CERTIFICATOR_VAULT_PATH_TEMPLATE" default:"certificates/{domain}" yaml:"vault_path_template"`
+	CAs               []CA          `ignored:"true" yaml:"cas"`
+	Domains           []Domain      `ignored:"true" yaml:"-"`
+	DNSProviders      []DNSProvider `ignored:"true" yaml:"-"`
+}
+
+// StringList is a list option, given as a comma separated string in environment variables
+// and as either a list or a comma separated string in config file
+type StringList []string
+
+// UnmarshalYAML accepts both list and comma separated string
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*l = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*l = append(*l, item)
+			}
+		}
+		return nil
+	}
+
+	var items []string
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	*l = items
+
+	return nil
+}
+
+// LoadConfig loads configuration options to  variable.
+// Options are read from optional YAML config file, environment variables override them.
+// If file is empty, CERTIFICATOR_CONFIG_FILE environment variable is used
+func LoadConfig(file string) (Config, error) {
+	cfg, err := loadConfig(file)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if cfg.Acme.AccountEmail == "" {
+		return Config{}, errors.New("required key ACME_ACCOUNT_EMAIL missing value")
+	}
+	if err := cfg.Vault.validateAuth(); err != nil {
+		return Config{}, err
+	}
+	// Certificates of entries with the same name would overwrite each other
+	if _, errs := duplicateNames(cfg.Domains); len(errs) > 0 {
+		return Config{}, errs[0]
+	}
+
+	return cfg, nil
+}
+
+// LoadDomainsConfig loads configuration options like LoadConfig, but does not require
+// ACME account email and Vault credentials, so that domains file can be checked without them.
+// Entries defined more than once are not rejected, ValidateDomains reports them
+func LoadDomainsConfig(file string) (Config, error) {
+	return loadConfig(file)
+}
+
+func loadConfig(file string) (Config, error) {
+	var envCfg Config
+	err := envconfig.Process("", &envCfg)
 	if err != nil {
 		return Config{}, errors.Wrapf(err, "failed getting config from env")
 	}
 
-	f, err := os.Open(cfg.DomainsFile)
+	if file == "" {
+		file = os.Getenv("CERTIFICATOR_CONFIG_FILE")
+	}
+
+	cfg := envCfg
+	if file != "" {
+		if cfg, err = mergeConfigFile(envCfg, file); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if len(cfg.DNSAddresses) == 0 {
+		return Config{}, errors.New("DNS_ADDRESS must list at least one resolver")
+	}
+
+	cfg.Domains, cfg.DNSProviders, err = loadDomainsFiles(cfg.DomainsFile)
 	if err != nil {
-		return Config{}, errors.Wrapf(err, "opening %s", cfg.DomainsFile)
+		return Config{}, err
+	}
+
+	if err := cfg.validateCAs(); err != nil {
+		return Config{}, err
+	}
+
+	if err := vault.ValidatePathTemplate(cfg.VaultPathTemplate); err != nil {
+		return Config{}, err
+	}
+	for _, domain := range cfg.Domains {
+		if _, err := cfg.CertificateLocation(domain); err != nil {
+			return Config{}, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// validateAuth checks that credentials required by Vault auth method are set
+func (v Vault) validateAuth() error {
+	var missing string
+	switch v.AuthMethod {
+	case "", vault.AuthToken, vault.AuthCert:
+	case vault.AuthTokenFile:
+		if v.TokenFile == "" {
+			missing = "VAULT_TOKEN_FILE"
+		}
+	case vault.AuthAppRole:
+		if v.ApproleRoleID == "" {
+			missing = "VAULT_APPROLE_ROLE_ID"
+		}
+	case vault.AuthKubernetes:
+		if v.Role == "" {
+			missing = "VAULT_ROLE"
+		}
+	case vault.AuthJWT, vault.AuthOIDC:
+		if v.Role == "" {
+			missing = "VAULT_ROLE"
+		} else if v.JWT == "" && v.JWTFile == "" {
+			missing = "VAULT_JWT or VAULT_JWT_FILE"
+		}
+	case vault.AuthUserpass:
+		if v.Username == "" {
+			missing = "VAULT_USERNAME"
+		}
+	default:
+		return errors.Errorf("unsupported VAULT_AUTH_METHOD %q", v.AuthMethod)
+	}
+
+	if missing != "" {
+		return errors.Errorf("vault auth method %s requires %s", v.AuthMethod, missing)
+	}
+
+	return nil
+}
+
+// VaultAuth returns Vault auth method with its credentials.
+// If auth method is not set, token from VAULT_DEV_ROOT_TOKEN_ID is used in dev environment
+// and approle method is used otherwise
+func (c Config) VaultAuth() vault.Auth {
+	v := c.Vault
+	if v.AuthMethod == "" {
+		if c.Environment == "dev" {
+			return vault.Auth{Method: vault.AuthToken, Token: os.Getenv("VAULT_DEV_ROOT_TOKEN_ID")}
+		}
+		v.AuthMethod = vault.AuthAppRole
+	}
+
+	return vault.Auth{
+		Method:              v.AuthMethod,
+		Mount:               v.AuthMount,
+		Role:                v.Role,
+		Token:               v.Token,
+		TokenFile:           v.TokenFile,
+		RoleID:              v.ApproleRoleID,
+		SecretID:            v.ApproleSecretID,
+		JWT:                 v.JWT,
+		JWTFile:             v.JWTFile,
+		KubernetesTokenFile: v.KubernetesTokenFile,
+		ClientCert:          v.ClientCert,
+		ClientKey:           v.ClientKey,
+		Username:            v.Username,
+		Password:            v.Password,
+	}
+}
+
+// CertificateLocation returns location of domains entry certificate in Vault KV storage.
+// Entry vault_path is used as is, otherwise entry or global path template is rendered
+func (c Config) CertificateLocation(d Domain) (string, error) {
+	if d.VaultPath != "" {
+		return d.VaultPath, nil
 	}
 
-	content, err := ioutil.ReadAll(f)
+	template := c.VaultPathTemplate
+	if d.VaultPathTemplate != "" {
+		template = d.VaultPathTemplate
+	}
+
+	location, err := vault.RenderPath(template, vault.PathVariables{
+		Domain:      d.Name,
+		Group:       d.Group,
+		Environment: c.Environment,
+	})
 	if err != nil {
-		return Config{}, errors.Wrapf(err, "reading content of %s", cfg.DomainsFile)
+		return "", errors.Wrapf(err, "domains entry %s", describe(d))
+	}
+
+	return location, nil
+}
+
+// CAProfiles returns configured CA profiles in failover order with defaults applied.
+// If no profiles are configured, a single profile named default is built from acme section
+func (c Config) CAProfiles() []CA {
+	if len(c.CAs) == 0 {
+		reregister := c.Acme.ReregisterAccount
+		return []CA{{
+			Name:              "default",
+			ServerURL:         c.Acme.ServerURL,
+			AccountEmail:      c.Acme.AccountEmail,
+			EABKeyID:          c.Acme.EABKeyID,
+			EABHMACKey:        c.Acme.EABHMACKey,
+			ReregisterAccount: &reregister,
+		}}
+	}
+
+	profiles := make([]CA, len(c.CAs))
+	for i, ca := range c.CAs {
+		if ca.AccountEmail == "" {
+			ca.AccountEmail = c.Acme.AccountEmail
+		}
+		if ca.ReregisterAccount == nil {
+			reregister := c.Acme.ReregisterAccount
+			ca.ReregisterAccount = &reregister
+		}
+		profiles[i] = ca
+	}
+
+	return profiles
+}
+
+// validateCAs checks that CA profiles are complete and domains refer to existing ones
+func (c Config) validateCAs() error {
+	names := make(map[string]bool, len(c.CAs))
+	for _, ca := range c.CAs {
+		if ca.Name == "" || ca.ServerURL == "" {
+			return errors.Errorf("CA profile %q must have name and server_url set", ca.Name)
+		}
+		if names[ca.Name] {
+			return errors.Errorf("CA profile %s is defined more than once", ca.Name)
+		}
+		names[ca.Name] = true
 	}
 
-	if err := yaml.Unmarshal(content, &cfg); err != nil {
-		return Config{}, errors.Wrapf(err, "parsing %s", cfg.DomainsFile)
+	for _, domain := range c.Domains {
+		if domain.CA == "" {
+			continue
+		}
+		if len(c.CAs) == 0 && domain.CA != "default" || len(c.CAs) > 0 && !names[domain.CA] {
+			return errors.Errorf("domain %s refers to unknown CA profile %s", domain.Name, domain.CA)
+		}
 	}
 
-	return cfg, err
+	return nil
 }
@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/vinted/certificator/pkg/vault"
+	"gopkg.in/yaml.v2"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -14,28 +16,52 @@ func TestDefaultConfig(t *testing.T) {
 	var expectedConf = Config{
 		Acme: Acme{
 			AccountEmail:              "test@test.com",
+			ChallengeType:             "dns-01",
 			DNSChallengeProvider:      "exec",
 			DNSPropagationRequirement: true,
+			HTTP01Address:             ":80",
+			TLSALPN01Address:          ":443",
+			StoreAlternateChains:      false,
 			ReregisterAccount:         false,
 			ServerURL:                 "https://acme-staging-v02.api.letsencrypt.org/directory",
+			CAFailover:                true,
 		},
 		Vault: Vault{
-			ApproleRoleID:   "",
-			ApproleSecretID: "",
-			KVStoragePath:   "secret/data/certificator/",
+			ApproleRoleID:       "",
+			ApproleSecretID:     "",
+			KubernetesTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			KVStoragePath:       "secret/certificator/",
 		},
 		Log: Log{
 			Format: "JSON",
 			Level:  "INFO",
 		},
-		DNSAddress:      "127.0.0.1:53",
-		Environment:     "prod",
-		DomainsFile:     "../../domains.yml",
-		Domains:         []string{"mydomain.com,www.mydomain.com", "example.com"},
-		RenewBeforeDays: 30,
+		DNSAddresses: StringList{"127.0.0.1:53"},
+		Environment:  "prod",
+		DomainsFile:  "../../domains.yml",
+		KeyType:      "RSA2048",
+		MaxSANs:      100,
+		Domains: []Domain{
+			{
+				Name:    "mydomain.com",
+				RawName: "mydomain.com",
+				SANs:    []string{"www.mydomain.com"},
+				Source:  "../../domains.yml",
+			},
+			{Name: "example.com", RawName: "example.com", Source: "../../domains.yml"},
+			{
+				Name:    "ecdsa.example.com",
+				RawName: "ecdsa.example.com",
+				SANs:    []string{"www.ecdsa.example.com"},
+				KeyType: "EC256",
+				Source:  "../../domains.yml",
+			},
+		},
+		RenewBeforeDays:   30,
+		VaultPathTemplate: "certificates/{domain}",
 	}
 
-	conf, err := LoadConfig()
+	conf, err := LoadConfig("")
 	testutil.Ok(t, err)
 	testutil.Equals(t, expectedConf, conf)
 }
@@ -44,39 +70,91 @@ func TestConfig(t *testing.T) {
 	var (
 		reregisterAcc        bool   = true
 		acmeServerURL        string = "http://someserver"
+		caFailover           bool   = false
 		dnsChallengeProvider string = "other"
+		dnsCredentialsPath   string = "dns/other"
 		dnsPropagationReq    bool   = false
 		vaultRoleID          string = "role"
 		vaultSecretID        string = "secret"
 		vaultKVStorePath     string = "secret/path"
+		eabKeyID             string = "kid"
+		eabHMACKey           string = "hmac"
+		preferredChain       string = "ISRG Root X1"
+		storeAltChains       bool   = true
+		challengeType        string = "http-01"
+		http01Address        string = "127.0.0.1:5002"
+		http01Webroot        string = "/var/www"
+		tlsalpn01Address     string = "127.0.0.1:5001"
 		logFormat            string = "LOGFMT"
 		logLevel             string = "DEBUG"
-		dnsAddress           string = "1.1.1.1:53"
+		dnsAddresses         string = "1.1.1.1:53,8.8.8.8:53"
+		dnsAuthoritative     bool   = true
+		dnsTimeout           int    = 300
+		dnsInterval          int    = 5
+		dnsTTL               int    = 60
 		environment          string = "test"
+		keyType              string = "EC384"
 		renewBeforeDays      int    = 60
+		maxSANs              int    = 50
+		vaultPathTemplate    string = "{environment}/certificates/{reversed_domain}"
 
 		expectedConf = Config{
 			Acme: Acme{
 				AccountEmail:              "test@test.com",
+				ChallengeType:             challengeType,
 				DNSChallengeProvider:      dnsChallengeProvider,
+				DNSCredentialsVaultPath:   dnsCredentialsPath,
 				DNSPropagationRequirement: dnsPropagationReq,
+				DNSAuthoritativeCheck:     dnsAuthoritative,
+				DNSPropagationTimeout:     dnsTimeout,
+				DNSPollingInterval:        dnsInterval,
+				DNSTTL:                    dnsTTL,
+				EABKeyID:                  eabKeyID,
+				EABHMACKey:                eabHMACKey,
+				HTTP01Address:             http01Address,
+				HTTP01Webroot:             http01Webroot,
+				TLSALPN01Address:          tlsalpn01Address,
+				PreferredChain:            preferredChain,
+				StoreAlternateChains:      storeAltChains,
 				ReregisterAccount:         reregisterAcc,
 				ServerURL:                 acmeServerURL,
+				CAFailover:                caFailover,
 			},
 			Vault: Vault{
-				ApproleRoleID:   vaultRoleID,
-				ApproleSecretID: vaultSecretID,
-				KVStoragePath:   vaultKVStorePath,
+				AuthMethod:          "approle",
+				AuthMount:           "approle-certificator",
+				ApproleRoleID:       vaultRoleID,
+				ApproleSecretID:     vaultSecretID,
+				KubernetesTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+				KVStoragePath:       vaultKVStorePath,
 			},
 			Log: Log{
 				Format: logFormat,
 				Level:  logLevel,
 			},
-			DNSAddress:      dnsAddress,
-			Environment:     environment,
-			DomainsFile:     "../../domains.yml",
-			Domains:         []string{"mydomain.com,www.mydomain.com", "example.com"},
-			RenewBeforeDays: renewBeforeDays,
+			DNSAddresses: StringList{"1.1.1.1:53", "8.8.8.8:53"},
+			Environment:  environment,
+			DomainsFile:  "../../domains.yml",
+			KeyType:      keyType,
+			MaxSANs:      maxSANs,
+			Domains: []Domain{
+				{
+					Name:    "mydomain.com",
+					RawName: "mydomain.com",
+					SANs:    []string{"www.mydomain.com"},
+					Source:  "../../domains.yml",
+				},
+				{Name: "example.com", RawName: "example.com", Source: "../../domains.yml"},
+				{
+					Name:    "ecdsa.example.com",
+					RawName: "ecdsa.example.com",
+					SANs:    []string{"www.ecdsa.example.com"},
+					KeyType: "EC256",
+					Source:  "../../domains.yml",
+				},
+			},
+			RenewBeforeDays:   renewBeforeDays,
+			VaultPathTemplate: vaultPathTemplate,
 		}
 	)
 
@@ -84,38 +162,492 @@ func TestConfig(t *testing.T) {
 
 	os.Setenv("ACME_REREGISTER_ACCOUNT", strconv.FormatBool(reregisterAcc))
 	os.Setenv("ACME_SERVER_URL", acmeServerURL)
+	os.Setenv("ACME_CA_FAILOVER", strconv.FormatBool(caFailover))
 	os.Setenv("ACME_DNS_CHALLENGE_PROVIDER", dnsChallengeProvider)
+	os.Setenv("ACME_DNS_CHALLENGE_PROVIDER_VAULT_PATH", dnsCredentialsPath)
 	os.Setenv("ACME_DNS_PROPAGATION_REQUIREMENT", strconv.FormatBool(dnsPropagationReq))
+	os.Setenv("ACME_EAB_KID", eabKeyID)
+	os.Setenv("ACME_EAB_HMAC_KEY", eabHMACKey)
+	os.Setenv("ACME_CHALLENGE_TYPE", challengeType)
+	os.Setenv("ACME_HTTP01_ADDRESS", http01Address)
+	os.Setenv("ACME_HTTP01_WEBROOT", http01Webroot)
+	os.Setenv("ACME_TLSALPN01_ADDRESS", tlsalpn01Address)
+	os.Setenv("ACME_PREFERRED_CHAIN", preferredChain)
+	os.Setenv("ACME_STORE_ALTERNATE_CHAINS", strconv.FormatBool(storeAltChains))
+	os.Setenv("VAULT_AUTH_METHOD", "approle")
+	os.Setenv("VAULT_AUTH_MOUNT", "approle-certificator")
 	os.Setenv("VAULT_APPROLE_ROLE_ID", vaultRoleID)
 	os.Setenv("VAULT_APPROLE_SECRET_ID", vaultSecretID)
 	os.Setenv("VAULT_KV_STORAGE_PATH", vaultKVStorePath)
 	os.Setenv("LOG_FORMAT", logFormat)
 	os.Setenv("LOG_LEVEL", logLevel)
-	os.Setenv("DNS_ADDRESS", dnsAddress)
+	os.Setenv("DNS_ADDRESS", dnsAddresses)
+	os.Setenv("ACME_DNS_AUTHORITATIVE_CHECK", strconv.FormatBool(dnsAuthoritative))
+	os.Setenv("ACME_DNS_PROPAGATION_TIMEOUT", strconv.Itoa(dnsTimeout))
+	os.Setenv("ACME_DNS_POLLING_INTERVAL", strconv.Itoa(dnsInterval))
+	os.Setenv("ACME_DNS_TTL", strconv.Itoa(dnsTTL))
 	os.Setenv("ENVIRONMENT", environment)
+	os.Setenv("CERTIFICATOR_KEY_TYPE", keyType)
 	os.Setenv("CERTIFICATOR_RENEW_BEFORE_DAYS", strconv.Itoa(renewBeforeDays))
+	os.Setenv("CERTIFICATOR_MAX_SANS", strconv.Itoa(maxSANs))
+	os.Setenv("CERTIFICATOR_VAULT_PATH_TEMPLATE", vaultPathTemplate)
 
-	conf, err := LoadConfig()
+	conf, err := LoadConfig("")
 	testutil.Ok(t, err)
 	testutil.Equals(t, expectedConf, conf)
 }
 
+func TestConfigFile(t *testing.T) {
+	resetEnvVars()
+	os.Unsetenv("ACME_ACCOUNT_EMAIL")
+	// Environment overrides config file
+	os.Setenv("LOG_LEVEL", "DEBUG")
+
+	conf, err := LoadConfig("testdata/config.yml")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "file@test.com", conf.Acme.AccountEmail)
+	testutil.Equals(t, "https://acme-v02.api.letsencrypt.org/directory", conf.Acme.ServerURL)
+	testutil.Equals(t, "role", conf.Vault.ApproleRoleID)
+	testutil.Equals(t, "LOGFMT", conf.Log.Format)
+	testutil.Equals(t, "DEBUG", conf.Log.Level)
+	testutil.Equals(t, 20, conf.RenewBeforeDays)
+	testutil.Equals(t, StringList{"10.0.0.1:53", "10.0.0.2:53"}, conf.DNSAddresses)
+	// Defaults are kept for options missing in config file
+	testutil.Equals(t, "secret/certificator/", conf.Vault.KVStoragePath)
+	testutil.Equals(t, "../../domains.yml", conf.DomainsFile)
+
+	os.Setenv("CERTIFICATOR_CONFIG_FILE", "testdata/config.yml")
+	conf, err = LoadConfig("")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "file@test.com", conf.Acme.AccountEmail)
+
+	_, err = LoadConfig("testdata/config-invalid.yml")
+	testutil.NotOk(t, err)
+
+	_, err = LoadConfig("testdata/missing.yml")
+	testutil.NotOk(t, err)
+
+	os.Setenv("CERTIFICATOR_VAULT_PATH_TEMPLATE", "certificates/{host}")
+	_, err = LoadConfig("testdata/config.yml")
+	testutil.NotOk(t, err)
+	os.Unsetenv("CERTIFICATOR_VAULT_PATH_TEMPLATE")
+
+	// Account email is required
+	os.Unsetenv("CERTIFICATOR_CONFIG_FILE")
+	_, err = LoadConfig("")
+	testutil.NotOk(t, err)
+
+	// Domains file can be checked without account email and Vault credentials
+	os.Setenv("VAULT_AUTH_METHOD", "approle")
+	conf, err = LoadDomainsConfig("")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(conf.Domains))
+	os.Unsetenv("VAULT_AUTH_METHOD")
+
+	// Entries defined in several domains files are reported by validation, but not used
+	os.Setenv("CERTIFICATOR_DOMAINS_FILE", "testdata/conflict")
+	conf, err = LoadDomainsConfig("")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(conf.Domains))
+	os.Setenv("ACME_ACCOUNT_EMAIL", "test@test.com")
+	_, err = LoadConfig("")
+	testutil.NotOk(t, err)
+}
+
+func TestRedacted(t *testing.T) {
+	conf := Config{
+		Acme:  Acme{AccountEmail: "test@test.com", EABKeyID: "kid", EABHMACKey: "hmac"},
+		Vault: Vault{ApproleRoleID: "role", ApproleSecretID: "secret", Token: "token", Password: "password"},
+		CAs:   []CA{{Name: "zerossl", EABKeyID: "kid", EABHMACKey: "hmac"}},
+	}
+
+	out, err := conf.Redacted()
+	testutil.Ok(t, err)
+
+	var redactedConf Config
+	testutil.Ok(t, yaml.Unmarshal(out, &redactedConf))
+	testutil.Equals(t, "test@test.com", redactedConf.Acme.AccountEmail)
+	testutil.Equals(t, "kid", redactedConf.Acme.EABKeyID)
+	testutil.Equals(t, redacted, redactedConf.Acme.EABHMACKey)
+	testutil.Equals(t, "role", redactedConf.Vault.ApproleRoleID)
+	testutil.Equals(t, redacted, redactedConf.Vault.ApproleSecretID)
+	testutil.Equals(t, redacted, redactedConf.Vault.Token)
+	testutil.Equals(t, redacted, redactedConf.Vault.Password)
+	testutil.Equals(t, "kid", redactedConf.CAs[0].EABKeyID)
+	testutil.Equals(t, redacted, redactedConf.CAs[0].EABHMACKey)
+	// Original configuration is not modified
+	testutil.Equals(t, "secret", conf.Vault.ApproleSecretID)
+	testutil.Equals(t, "hmac", conf.CAs[0].EABHMACKey)
+
+	// Empty secrets are left empty
+	out, err = Config{}.Redacted()
+	testutil.Ok(t, err)
+	testutil.Ok(t, yaml.Unmarshal(out, &redactedConf))
+	testutil.Equals(t, "", redactedConf.Vault.ApproleSecretID)
+}
+
+func TestValidateVaultAuth(t *testing.T) {
+	for _, tcase := range []struct {
+		name  string
+		vault Vault
+		err   bool
+	}{
+		{name: "legacy", vault: Vault{}},
+		{name: "token", vault: Vault{AuthMethod: "token"}},
+		{name: "token file", vault: Vault{AuthMethod: "token_file", TokenFile: "/run/vault/token"}},
+		{name: "token file missing", vault: Vault{AuthMethod: "token_file"}, err: true},
+		{name: "approle", vault: Vault{AuthMethod: "approle", ApproleRoleID: "role"}},
+		{name: "approle without role id", vault: Vault{AuthMethod: "approle"}, err: true},
+		{name: "kubernetes", vault: Vault{AuthMethod: "kubernetes", Role: "certificator"}},
+		{name: "kubernetes without role", vault: Vault{AuthMethod: "kubernetes"}, err: true},
+		{name: "jwt", vault: Vault{AuthMethod: "jwt", Role: "certificator", JWTFile: "/run/jwt"}},
+		{name: "oidc without jwt", vault: Vault{AuthMethod: "oidc", Role: "certificator"}, err: true},
+		{name: "cert", vault: Vault{AuthMethod: "cert"}},
+		{name: "userpass", vault: Vault{AuthMethod: "userpass", Username: "certificator"}},
+		{name: "userpass without username", vault: Vault{AuthMethod: "userpass"}, err: true},
+		{name: "unknown", vault: Vault{AuthMethod: "github"}, err: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			err := tcase.vault.validateAuth()
+			if tcase.err {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+		})
+	}
+}
+
+func TestVaultAuth(t *testing.T) {
+	os.Setenv("VAULT_DEV_ROOT_TOKEN_ID", "devtoken")
+	defer os.Unsetenv("VAULT_DEV_ROOT_TOKEN_ID")
+
+	conf := Config{Environment: "dev", Vault: Vault{ApproleRoleID: "role", ApproleSecretID: "secret"}}
+	testutil.Equals(t, vault.Auth{Method: "token", Token: "devtoken"}, conf.VaultAuth())
+
+	conf.Environment = "prod"
+	testutil.Equals(t, vault.Auth{Method: "approle", RoleID: "role", SecretID: "secret"}, conf.VaultAuth())
+
+	// Auth method does not depend on environment
+	conf.Environment = "dev"
+	conf.Vault = Vault{AuthMethod: "userpass", AuthMount: "ldap-users", Username: "user", Password: "pass"}
+	testutil.Equals(t, vault.Auth{Method: "userpass", Mount: "ldap-users", Username: "user", Password: "pass"},
+		conf.VaultAuth())
+}
+
+func TestCertificateLocation(t *testing.T) {
+	conf := Config{VaultPathTemplate: "certificates/{domain}", Environment: "prod"}
+
+	for _, tcase := range []struct {
+		domain   Domain
+		expected string
+		err      bool
+	}{
+		{domain: Domain{Name: "example.com"}, expected: "certificates/example.com"},
+		{domain: Domain{Name: "*.example.com"}, expected: "certificates/_wildcard.example.com"},
+		{domain: Domain{Name: "example.com", VaultPath: "custom/path"}, expected: "custom/path"},
+		{
+			domain:   Domain{Name: "www.example.com", Group: "team-a", VaultPathTemplate: "{environment}/{group}/{reversed_domain}"},
+			expected: "prod/team-a/com.example.www",
+		},
+		{domain: Domain{Name: "example.com", VaultPathTemplate: "{group}/{domain}"}, err: true},
+	} {
+		t.Run(tcase.expected, func(t *testing.T) {
+			location, err := conf.CertificateLocation(tcase.domain)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, location)
+		})
+	}
+}
+
+func TestCAProfiles(t *testing.T) {
+	reregister, noReregister := true, false
+	acme := Acme{
+		AccountEmail:      "test@test.com",
+		ServerURL:         "https://acme.test/dir",
+		EABKeyID:          "kid",
+		EABHMACKey:        "hmac",
+		ReregisterAccount: true,
+	}
+
+	conf := Config{Acme: acme}
+	testutil.Equals(t, []CA{{
+		Name:              "default",
+		ServerURL:         "https://acme.test/dir",
+		AccountEmail:      "test@test.com",
+		EABKeyID:          "kid",
+		EABHMACKey:        "hmac",
+		ReregisterAccount: &reregister,
+	}}, conf.CAProfiles())
+
+	conf.CAs = []CA{
+		{Name: "letsencrypt", ServerURL: "https://letsencrypt.test/dir"},
+		{Name: "zerossl", ServerURL: "https://zerossl.test/dir", AccountEmail: "zerossl@test.com",
+			ReregisterAccount: &noReregister},
+	}
+	testutil.Equals(t, []CA{
+		{Name: "letsencrypt", ServerURL: "https://letsencrypt.test/dir", AccountEmail: "test@test.com",
+			ReregisterAccount: &reregister},
+		{Name: "zerossl", ServerURL: "https://zerossl.test/dir", AccountEmail: "zerossl@test.com",
+			ReregisterAccount: &noReregister},
+	}, conf.CAProfiles())
+}
+
+func TestValidateCAs(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		cas  []CA
+		ca   string
+		err  bool
+	}{
+		{name: "default profile", ca: "default"},
+		{name: "unknown default profile", ca: "letsencrypt", err: true},
+		{name: "configured profile", cas: []CA{{Name: "letsencrypt", ServerURL: "https://le.test"}}, ca: "letsencrypt"},
+		{name: "unknown profile", cas: []CA{{Name: "letsencrypt", ServerURL: "https://le.test"}}, ca: "default", err: true},
+		{name: "profile without URL", cas: []CA{{Name: "letsencrypt"}}, err: true},
+		{
+			name: "duplicate profile",
+			cas:  []CA{{Name: "le", ServerURL: "https://le.test"}, {Name: "le", ServerURL: "https://le2.test"}},
+			err:  true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			conf := Config{CAs: tcase.cas, Domains: []Domain{{Name: "example.com", CA: tcase.ca}}}
+			err := conf.validateCAs()
+			if tcase.err {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+		})
+	}
+}
+
+func TestDomainUnmarshal(t *testing.T) {
+	storeAltChains := true
+
+	for _, tcase := range []struct {
+		name     string
+		yaml     string
+		expected Domain
+		err      bool
+	}{
+		{
+			name:     "single domain string",
+			yaml:     "example.com",
+			expected: Domain{Name: "example.com", RawName: "example.com"},
+		},
+		{
+			name:     "comma separated string",
+			yaml:     "'example.com, www.example.com,'",
+			expected: Domain{Name: "example.com", RawName: "example.com", SANs: []string{"www.example.com"}},
+		},
+		{
+			name: "object",
+			yaml: `
+name: example.com
+sans: [www.example.com, api.example.com]
+key_type: EC256
+challenge: http-01
+dns_provider: route53
+renew_before_days: 20
+vault_path: certificates/custom
+store_alternate_chains: true`,
+			expected: Domain{
+				Name:                 "example.com",
+				RawName:              "example.com",
+				SANs:                 []string{"www.example.com", "api.example.com"},
+				KeyType:              "EC256",
+				Challenge:            "http-01",
+				DNSProvider:          "route53",
+				RenewBeforeDays:      20,
+				VaultPath:            "certificates/custom",
+				StoreAlternateChains: &storeAltChains,
+			},
+		},
+		{
+			name: "names are normalized",
+			yaml: "{name: 'WWW.Example.com.', sans: ['*.Bücher.example']}",
+			expected: Domain{
+				Name:    "www.example.com",
+				RawName: "WWW.Example.com.",
+				SANs:    []string{"*.xn--bcher-kva.example"},
+			},
+		},
+		{
+			name: "object with comma separated domains",
+			yaml: "{domains: 'example.com,www.example.com', key_type: EC384}",
+			expected: Domain{
+				Name:    "example.com",
+				RawName: "example.com",
+				SANs:    []string{"www.example.com"},
+				KeyType: "EC384",
+			},
+		},
+		{
+			name: "object with both domains and name",
+			yaml: "{domains: 'example.com', name: example.com}",
+			err:  true,
+		},
+		{
+			name: "object without name",
+			yaml: "{sans: [www.example.com]}",
+			err:  true,
+		},
+		{
+			name: "empty string",
+			yaml: "''",
+			err:  true,
+		},
+		{
+			name: "both vault path and template",
+			yaml: "{name: example.com, vault_path: certs/example, vault_path_template: 'certs/{domain}'}",
+			err:  true,
+		},
+		{
+			name: "negative renew before days",
+			yaml: "{name: example.com, renew_before_days: -1}",
+			err:  true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var domain Domain
+			err := yaml.Unmarshal([]byte(tcase.yaml), &domain)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, domain)
+			testutil.Equals(t, append([]string{tcase.expected.Name}, tcase.expected.SANs...), domain.AllDomains())
+		})
+	}
+}
+
+func TestStringListUnmarshal(t *testing.T) {
+	for _, tcase := range []struct {
+		yaml     string
+		expected StringList
+	}{
+		{yaml: "1.1.1.1:53", expected: StringList{"1.1.1.1:53"}},
+		{yaml: "'1.1.1.1:53, 8.8.8.8:53,'", expected: StringList{"1.1.1.1:53", "8.8.8.8:53"}},
+		{yaml: "[1.1.1.1:53, 8.8.8.8:53]", expected: StringList{"1.1.1.1:53", "8.8.8.8:53"}},
+	} {
+		t.Run(tcase.yaml, func(t *testing.T) {
+			var list StringList
+			testutil.Ok(t, yaml.Unmarshal([]byte(tcase.yaml), &list))
+			testutil.Equals(t, tcase.expected, list)
+		})
+	}
+}
+
+func TestDNSProviderUnmarshal(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		yaml     string
+		expected DNSProvider
+		err      bool
+	}{
+		{
+			name: "zones",
+			yaml: "{provider: route53, zones: [example.com], settings: {AWS_REGION: eu-west-1}, vault_path: dns/route53}",
+			expected: DNSProvider{
+				Provider:  "route53",
+				Zones:     []string{"example.com"},
+				Settings:  map[string]string{"AWS_REGION": "eu-west-1"},
+				VaultPath: "dns/route53",
+			},
+		},
+		{
+			name:     "name",
+			yaml:     "{name: internal, provider: rfc2136}",
+			expected: DNSProvider{Name: "internal", Provider: "rfc2136"},
+		},
+		{
+			name: "no provider",
+			yaml: "{name: internal, zones: [example.com]}",
+			err:  true,
+		},
+		{
+			name: "neither name nor zones",
+			yaml: "{provider: route53}",
+			err:  true,
+		},
+		{
+			name: "timing",
+			yaml: "{name: internal, provider: rfc2136, propagation_timeout: 600, polling_interval: 10, ttl: 30}",
+			expected: DNSProvider{Name: "internal", Provider: "rfc2136", PropagationTimeout: 600,
+				PollingInterval: 10, TTL: 30},
+		},
+		{
+			name: "negative timing",
+			yaml: "{name: internal, provider: rfc2136, ttl: -1}",
+			err:  true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var provider DNSProvider
+			err := yaml.Unmarshal([]byte(tcase.yaml), &provider)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, provider)
+		})
+	}
+}
+
 func resetEnvVars() {
 	// Set required env vars
 	os.Setenv("ACME_ACCOUNT_EMAIL", "test@test.com")
 	os.Setenv("ACME_DNS_CHALLENGE_PROVIDER", "exec")
 	os.Setenv("CERTIFICATOR_DOMAINS_FILE", "../../domains.yml")
 
-	for _, key := range []string{"ACME_REREGISTER_ACCOUNT",
+	for _, key := range []string{"CERTIFICATOR_CONFIG_FILE",
+		"ACME_REREGISTER_ACCOUNT",
 		"ACME_SERVER_URL",
+		"ACME_CA_FAILOVER",
+		"ACME_EAB_KID",
+		"ACME_EAB_HMAC_KEY",
+		"ACME_DNS_CHALLENGE_PROVIDER_VAULT_PATH",
+		"ACME_CHALLENGE_TYPE",
+		"ACME_HTTP01_ADDRESS",
+		"ACME_HTTP01_WEBROOT",
+		"ACME_TLSALPN01_ADDRESS",
+		"ACME_PREFERRED_CHAIN",
+		"ACME_STORE_ALTERNATE_CHAINS",
+		"VAULT_AUTH_METHOD",
+		"VAULT_AUTH_MOUNT",
+		"VAULT_ROLE",
+		"VAULT_TOKEN",
+		"VAULT_TOKEN_FILE",
 		"VAULT_APPROLE_ROLE_ID",
 		"VAULT_APPROLE_SECRET_ID",
+		"VAULT_JWT",
+		"VAULT_JWT_FILE",
+		"VAULT_KUBERNETES_TOKEN_FILE",
+		"VAULT_CLIENT_CERT",
+		"VAULT_CLIENT_KEY",
+		"VAULT_USERNAME",
+		"VAULT_PASSWORD",
 		"VAULT_KV_STORAGE_PATH",
 		"LOG_FORMAT",
 		"LOG_LEVEL",
 		"DNS_ADDRESS",
+		"ACME_DNS_AUTHORITATIVE_CHECK",
+		"ACME_DNS_PROPAGATION_TIMEOUT",
+		"ACME_DNS_POLLING_INTERVAL",
+		"ACME_DNS_TTL",
 		"ENVIRONMENT",
+		"CERTIFICATOR_KEY_TYPE",
 		"CERTIFICATOR_RENEW_BEFORE_DAYS",
+		"CERTIFICATOR_MAX_SANS",
+		"CERTIFICATOR_VAULT_PATH_TEMPLATE",
 	} {
 		os.Unsetenv(key)
 	}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// domainsFile is content of a single domains file
+type domainsFile struct {
+	// Include lists other domains files, directories or globs, relative paths are resolved
+	// against the directory of the including file
+	Include      []string      `yaml:"include"`
+	Domains      []Domain      `yaml:"domains"`
+	DNSProviders []DNSProvider `yaml:"dns_providers"`
+}
+
+// domainsLoader merges domains files, remembering where every entry came from
+type domainsLoader struct {
+	loaded       map[string]bool
+	domains      []Domain
+	dnsProviders []DNSProvider
+	providers    map[string]string
+}
+
+// loadDomainsFiles loads domains entries and DNS providers from a file, all YAML files
+// of a directory or files matching a glob, following their includes.
+// Entries defined more than once are kept, they are reported by duplicateNames
+func loadDomainsFiles(location string) ([]Domain, []DNSProvider, error) {
+	loader := domainsLoader{
+		loaded:    make(map[string]bool),
+		providers: make(map[string]string),
+	}
+
+	if err := loader.load(location); err != nil {
+		return nil, nil, err
+	}
+
+	return loader.domains, loader.dnsProviders, nil
+}
+
+// load loads all domains files at location
+func (l *domainsLoader) load(location string) error {
+	files, err := domainsFilePaths(location)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := l.loadFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *domainsLoader) loadFile(file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	// Files included several times, or including each other, are loaded once
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "reading content of %s", file)
+	}
+
+	var parsed domainsFile
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		return errors.Wrapf(err, "parsing %s", file)
+	}
+
+	for _, domain := range parsed.Domains {
+		domain.Source = file
+		l.domains = append(l.domains, domain)
+	}
+
+	for _, provider := range parsed.DNSProviders {
+		provider.Source = file
+		if provider.Name != "" {
+			if other, ok := l.providers[provider.Name]; ok {
+				return errors.Errorf("dns provider %s is defined in both %s and %s", provider.Name, other, file)
+			}
+			l.providers[provider.Name] = file
+		}
+		l.dnsProviders = append(l.dnsProviders, provider)
+	}
+
+	for _, include := range parsed.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		if err := l.load(include); err != nil {
+			return errors.Wrapf(err, "including %s from %s", include, file)
+		}
+	}
+
+	return nil
+}
+
+// domainsFilePaths returns domains files at location, which can be a file, a directory or a glob.
+// Directories contain domains files with .yml or .yaml extension, their subdirectories are not loaded
+func domainsFilePaths(location string) ([]string, error) {
+	info, err := os.Stat(location)
+	switch {
+	case err == nil && info.IsDir():
+		var files []string
+		for _, pattern := range []string{"*.yml", "*.yaml"} {
+			matches, err := filepath.Glob(filepath.Join(location, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		if len(files) == 0 {
+			return nil, errors.Errorf("no domains files in %s", location)
+		}
+		sort.Strings(files)
+
+		return files, nil
+	case err == nil:
+		return []string{location}, nil
+	case os.IsNotExist(err) && strings.ContainsAny(location, "*?["):
+		files, err := filepath.Glob(location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "matching %s", location)
+		}
+		if len(files) == 0 {
+			return nil, errors.Errorf("no domains files match %s", location)
+		}
+
+		return files, nil
+	default:
+		return nil, errors.Wrapf(err, "opening %s", location)
+	}
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestLoadDomainsFiles(t *testing.T) {
+	for _, tcase := range []struct {
+		location  string
+		domains   map[string]string
+		providers map[string]string
+		err       string
+	}{
+		{
+			location: "testdata/domains.yml",
+			domains: map[string]string{
+				"example.com":        "testdata/domains.yml",
+				"team-a.example.com": "testdata/domains.d/team-a.yml",
+				"team-b.example.com": "testdata/domains.d/team-b.yaml",
+				"extra.example.com":  "testdata/extra-1.yml",
+			},
+			providers: map[string]string{"team-a": "testdata/domains.d/team-a.yml"},
+		},
+		{
+			location: "testdata/domains.d",
+			domains: map[string]string{
+				"example.com":        "testdata/domains.yml",
+				"team-a.example.com": "testdata/domains.d/team-a.yml",
+				"team-b.example.com": "testdata/domains.d/team-b.yaml",
+				"extra.example.com":  "testdata/extra-1.yml",
+			},
+			providers: map[string]string{"team-a": "testdata/domains.d/team-a.yml"},
+		},
+		{
+			location: "testdata/extra-*.yml",
+			domains:  map[string]string{"extra.example.com": "testdata/extra-1.yml"},
+		},
+		{
+			location: "testdata/missing-*.yml",
+			err:      "no domains files match testdata/missing-*.yml",
+		},
+	} {
+		t.Run(tcase.location, func(t *testing.T) {
+			domains, providers, err := loadDomainsFiles(tcase.location)
+			if tcase.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Equals(t, tcase.err, err.Error())
+				return
+			}
+			testutil.Ok(t, err)
+
+			sources := make(map[string]string, len(domains))
+			for _, domain := range domains {
+				sources[domain.Name] = domain.Source
+			}
+			testutil.Equals(t, tcase.domains, sources)
+
+			providerSources := make(map[string]string, len(providers))
+			for _, provider := range providers {
+				providerSources[provider.Name] = provider.Source
+			}
+			if tcase.providers == nil {
+				tcase.providers = map[string]string{}
+			}
+			testutil.Equals(t, tcase.providers, providerSources)
+		})
+	}
+}
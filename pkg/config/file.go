@@ -0,0 +1,79 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces values of secret options in printed configuration
+const redacted = "REDACTED"
+
+// mergeConfigFile returns configuration read from YAML file on top of defaults in envCfg.
+// Options set in environment variables keep values of envCfg
+func mergeConfigFile(envCfg Config, file string) (Config, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Config{}, errors.Wrapf(err, "reading content of %s", file)
+	}
+
+	cfg := envCfg
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return Config{}, errors.Wrapf(err, "parsing %s", file)
+	}
+
+	overrideFromEnv(reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(envCfg))
+
+	return cfg, nil
+}
+
+// overrideFromEnv copies options whose environment variable is set from envCfg to cfg
+func overrideFromEnv(cfg, envCfg reflect.Value) {
+	for i := 0; i < cfg.NumField(); i++ {
+		field := cfg.Type().Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			overrideFromEnv(cfg.Field(i), envCfg.Field(i))
+			continue
+		}
+
+		if key := field.Tag.Get("envconfig"); key != "" {
+			if _, ok := os.LookupEnv(key); ok {
+				cfg.Field(i).Set(envCfg.Field(i))
+			}
+		}
+	}
+}
+
+// Redacted returns configuration in YAML config file format, values of secret options are redacted
+func (c Config) Redacted() ([]byte, error) {
+	redactSecrets(reflect.ValueOf(&c).Elem())
+
+	return yaml.Marshal(c)
+}
+
+func redactSecrets(cfg reflect.Value) {
+	for i := 0; i < cfg.NumField(); i++ {
+		field := cfg.Type().Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			redactSecrets(cfg.Field(i))
+			continue
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			// Slice is copied, so that redacting does not modify the original configuration
+			items := reflect.MakeSlice(field.Type, cfg.Field(i).Len(), cfg.Field(i).Len())
+			reflect.Copy(items, cfg.Field(i))
+			for j := 0; j < items.Len(); j++ {
+				redactSecrets(items.Index(j))
+			}
+			cfg.Field(i).Set(items)
+			continue
+		}
+
+		if field.Tag.Get("secret") == "true" && cfg.Field(i).String() != "" {
+			cfg.Field(i).SetString(redacted)
+		}
+	}
+}
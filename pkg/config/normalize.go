@@ -0,0 +1,56 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// NormalizeDomain converts domain name to the form CA uses in certificates:
+// surrounding spaces and dots are trimmed, name is lowercased
+// and internationalized labels are converted to A-labels (punycode)
+func NormalizeDomain(name string) (string, error) {
+	name = strings.Trim(name, " \t.")
+
+	var wildcard string
+	if strings.HasPrefix(name, "*.") {
+		wildcard, name = "*.", name[2:]
+	}
+
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "normalizing domain %s", wildcard+name)
+	}
+
+	return wildcard + ascii, nil
+}
+
+// normalize normalizes all entry names, the original name is kept in RawName.
+// Names that can not be normalized are only trimmed and lowercased, so that loading does not fail
+// because of a single entry. Their errors are reported by ValidateDomains
+func (d *Domain) normalize() {
+	if d.RawName == "" {
+		d.RawName = d.Name
+	}
+
+	d.Name = d.normalizeName(d.Name)
+	for i, san := range d.SANs {
+		d.SANs[i] = d.normalizeName(san)
+	}
+}
+
+func (d *Domain) normalizeName(name string) string {
+	normalized, err := NormalizeDomain(name)
+	if err == nil {
+		return normalized
+	}
+
+	normalized = strings.ToLower(strings.Trim(name, " \t."))
+	if d.nameErrors == nil {
+		d.nameErrors = make(map[string]error)
+	}
+	d.nameErrors[normalized] = err
+
+	return normalized
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		expected string
+		err      bool
+	}{
+		{name: "example.com", expected: "example.com"},
+		{name: "WWW.Example.COM", expected: "www.example.com"},
+		{name: " example.com. ", expected: "example.com"},
+		{name: "*.Example.com.", expected: "*.example.com"},
+		{name: "пример.рф", expected: "xn--e1afmkfd.xn--p1ai"},
+		{name: "*.Bücher.example", expected: "*.xn--bcher-kva.example"},
+		{name: "xn--e1afmkfd.xn--p1ai", expected: "xn--e1afmkfd.xn--p1ai"},
+		{name: "exa mple.com", err: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			normalized, err := NormalizeDomain(tcase.name)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, normalized)
+		})
+	}
+}
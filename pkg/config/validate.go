@@ -0,0 +1,241 @@
+package config
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ValidateDomains checks domains entries for problems that would make CA reject orders
+// or certificates overwrite each other in Vault. location returns Vault KV location of entry certificate.
+// All found problems are returned
+func ValidateDomains(domains []Domain, maxSANs int, location func(Domain) (string, error)) []error {
+	duplicates, errs := duplicateNames(domains)
+
+	for _, domain := range domains {
+		errs = append(errs, validateDomain(domain, maxSANs)...)
+	}
+
+	// Entries repeating a name are already reported, their overlap and location would be reported again
+	names := make(map[string]string)
+	sets := make(map[string]string)
+	locations := make(map[string]string)
+	for i, domain := range domains {
+		if duplicates[i] {
+			continue
+		}
+
+		all := lowerDomains(domain.AllDomains())
+
+		set := append([]string(nil), all...)
+		sort.Strings(set)
+		key := strings.Join(set, ",")
+		if other, ok := sets[key]; ok {
+			errs = append(errs, errors.Errorf("entry %s duplicates entry %s", describe(domain), other))
+		} else {
+			sets[key] = describe(domain)
+
+			seen := make(map[string]bool, len(all))
+			for _, name := range all {
+				if other, ok := names[name]; ok && !seen[name] {
+					errs = append(errs, errors.Errorf("entry %s overlaps with entry %s: %s is in both",
+						describe(domain), other, name))
+				} else if !ok {
+					names[name] = describe(domain)
+				}
+				seen[name] = true
+			}
+		}
+
+		loc, err := location(domain)
+		if err != nil {
+			errs = append(errs, err)
+		} else if other, ok := locations[loc]; ok {
+			errs = append(errs, errors.Errorf("entries %s and %s are stored at the same Vault location %s",
+				other, describe(domain), loc))
+		} else {
+			locations[loc] = describe(domain)
+		}
+	}
+
+	return append(errs, validateWildcardCoverage(domains, duplicates)...)
+}
+
+// duplicateNames reports entries with the same name, e.g. defined in several domains files.
+// Indexes of entries repeating a name are returned along with the errors
+func duplicateNames(domains []Domain) (map[int]bool, []error) {
+	var errs []error
+
+	duplicates := make(map[int]bool)
+	sources := make(map[string]string)
+	for i, domain := range domains {
+		name := strings.ToLower(domain.Name)
+		other, ok := sources[name]
+		switch {
+		case !ok:
+			sources[name] = domain.Source
+			continue
+		case other == domain.Source && other == "":
+			errs = append(errs, errors.Errorf("domain %s is defined more than once", domain.Name))
+		case other == domain.Source:
+			errs = append(errs, errors.Errorf("domain %s is defined more than once in %s", domain.Name, other))
+		default:
+			errs = append(errs, errors.Errorf("domain %s is defined in both %s and %s", domain.Name, other,
+				domain.Source))
+		}
+		duplicates[i] = true
+	}
+
+	return duplicates, errs
+}
+
+// validateWildcardCoverage reports names covered by a wildcard of another entry once per entry,
+// names covered by a wildcard of the same entry are reported by validateDomain. Duplicates are skipped
+func validateWildcardCoverage(domains []Domain, duplicates map[int]bool) []error {
+	var errs []error
+
+	wildcards := make(map[string]int)
+	for i, domain := range domains {
+		if duplicates[i] {
+			continue
+		}
+		for _, name := range lowerDomains(domain.AllDomains()) {
+			if _, ok := wildcards[name]; strings.HasPrefix(name, "*.") && !ok {
+				wildcards[name] = i
+			}
+		}
+	}
+
+	for i, domain := range domains {
+		if duplicates[i] {
+			continue
+		}
+
+		all := lowerDomains(domain.AllDomains())
+		own := make(map[string]bool, len(all))
+		for _, name := range all {
+			own[name] = true
+		}
+
+		reported := make(map[string]bool)
+		for _, name := range domain.AllDomains() {
+			lower := strings.ToLower(name)
+			dot := strings.Index(lower, ".")
+			if strings.HasPrefix(lower, "*.") || dot <= 0 || reported[lower] || own["*"+lower[dot:]] {
+				continue
+			}
+			if other, ok := wildcards["*"+lower[dot:]]; ok && other != i {
+				reported[lower] = true
+				errs = append(errs, errors.Errorf("entry %s contains %s, which is already covered by *%s of entry %s",
+					describe(domain), name, lower[dot:], describe(domains[other])))
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateDomain checks names of a single entry
+func validateDomain(domain Domain, maxSANs int) []error {
+	var errs []error
+
+	all := domain.AllDomains()
+	if maxSANs > 0 && len(all) > maxSANs {
+		errs = append(errs, errors.Errorf("entry %s has %d domains, CA allows at most %d",
+			describe(domain), len(all), maxSANs))
+	}
+
+	seen := make(map[string]bool, len(all))
+	for _, name := range all {
+		if err := validateHostname(name); err != nil {
+			errs = append(errs, errors.Wrapf(err, "entry %s", describe(domain)))
+			continue
+		}
+		if err := domain.nameErrors[name]; err != nil {
+			errs = append(errs, errors.Wrapf(err, "entry %s", describe(domain)))
+			continue
+		}
+
+		lower := strings.ToLower(name)
+		if seen[lower] {
+			errs = append(errs, errors.Errorf("entry %s contains %s more than once", describe(domain), name))
+		}
+		seen[lower] = true
+	}
+
+	// Names covered by a wildcard of the same entry are redundant, repeated names are reported once
+	reported := make(map[string]bool)
+	for _, name := range all {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "*.") || reported[lower] {
+			continue
+		}
+		if i := strings.Index(lower, "."); i > 0 && seen["*"+lower[i:]] {
+			reported[lower] = true
+			errs = append(errs, errors.Errorf("entry %s contains %s, which is already covered by *%s",
+				describe(domain), name, lower[i:]))
+		}
+	}
+
+	return errs
+}
+
+// validateHostname checks that name is a valid DNS hostname, optionally prefixed by a wildcard label
+func validateHostname(name string) error {
+	hostname := strings.TrimPrefix(name, "*.")
+	if strings.Contains(hostname, "*") {
+		return errors.Errorf("%s: wildcard is allowed only as the whole leftmost label", name)
+	}
+	if net.ParseIP(hostname) != nil {
+		return errors.Errorf("%s: IP addresses are not supported", name)
+	}
+	if len(hostname) > 253 {
+		return errors.Errorf("%s: name is longer than 253 characters", name)
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return errors.Errorf("%s: name must have at least two labels", name)
+	}
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return errors.Errorf("%s: label %q must be 1 to 63 characters long", name, label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.Errorf("%s: label %q must not start or end with a hyphen", name, label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return errors.Errorf("%s: label %q contains invalid character %q", name, label, r)
+			}
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if strings.Trim(tld, "0123456789") == "" {
+		return errors.Errorf("%s: top level domain must not be numeric", name)
+	}
+
+	return nil
+}
+
+// describe returns entry name followed by domains file it is defined in
+func describe(domain Domain) string {
+	if domain.Source == "" {
+		return domain.Name
+	}
+
+	return domain.Name + " (" + domain.Source + ")"
+}
+
+func lowerDomains(domains []string) []string {
+	lower := make([]string, len(domains))
+	for i, domain := range domains {
+		lower[i] = strings.ToLower(domain)
+	}
+
+	return lower
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestValidateHostname(t *testing.T) {
+	for _, tcase := range []struct {
+		name  string
+		valid bool
+	}{
+		{name: "example.com", valid: true},
+		{name: "www.Example.com", valid: true},
+		{name: "*.example.com", valid: true},
+		{name: "xn--e1afmkfd.xn--p1ai", valid: true},
+		{name: "my-host.example.com", valid: true},
+		{name: "*.*.example.com"},
+		{name: "www.*.example.com"},
+		{name: "w*.example.com"},
+		{name: "*"},
+		{name: "localhost"},
+		{name: "example..com"},
+		{name: "-example.com"},
+		{name: "example-.com"},
+		{name: "exa_mple.com"},
+		{name: "1.2.3.4"},
+		{name: "example.123"},
+		{name: "a123456789012345678901234567890123456789012345678901234567890123.com"},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			err := validateHostname(tcase.name)
+			if tcase.valid {
+				testutil.Ok(t, err)
+			} else {
+				testutil.NotOk(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateDomains(t *testing.T) {
+	location := Config{VaultPathTemplate: "certificates/{domain}"}.CertificateLocation
+
+	for _, tcase := range []struct {
+		name    string
+		domains []Domain
+		maxSANs int
+		errors  int
+	}{
+		{
+			name: "valid",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"*.example.com"}},
+				{Name: "example.org", SANs: []string{"www.example.org"}},
+			},
+			maxSANs: 100,
+		},
+		{
+			name: "invalid hostname",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"*.*.example.com"}},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "redundant subdomain",
+			domains: []Domain{
+				{Name: "*.example.com", SANs: []string{"www.example.com", "example.com"}},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "duplicate name in entry",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"EXAMPLE.com"}},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "too many SANs",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"a.example.com", "b.example.com"}},
+			},
+			maxSANs: 2,
+			errors:  1,
+		},
+		{
+			name: "duplicate entries",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"www.example.com"}},
+				{Name: "www.example.com", SANs: []string{"example.com"}},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "overlapping entries",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"www.example.com"}},
+				{Name: "example.org", SANs: []string{"www.example.com"}},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "name covered by wildcard of other entry",
+			domains: []Domain{
+				{Name: "example.com", SANs: []string{"*.example.com"}},
+				{Name: "www.example.com"},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "repeated name covered by wildcard",
+			domains: []Domain{
+				{Name: "*.example.com", SANs: []string{"www.example.com", "www.example.com"}},
+				{Name: "example.org", SANs: []string{"www.example.com", "www.example.com"}},
+			},
+			maxSANs: 100,
+			// Repeated names in both entries, redundant name in each entry and overlap of entries
+			errors: 5,
+		},
+		{
+			name: "same vault location",
+			domains: []Domain{
+				{Name: "example.com"},
+				{Name: "example.org", VaultPath: "certificates/example.com"},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+		{
+			name: "same name and vault location",
+			domains: []Domain{
+				{Name: "example.com"},
+				{Name: "example.com", SANs: []string{"www.example.com"}},
+			},
+			maxSANs: 100,
+			errors:  1,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			errs := ValidateDomains(tcase.domains, tcase.maxSANs, location)
+			testutil.Equals(t, tcase.errors, len(errs), "errors: %v", errs)
+		})
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	domains, _, err := loadDomainsFiles("testdata/conflict")
+	testutil.Ok(t, err)
+
+	_, errs := duplicateNames(domains)
+	testutil.Equals(t, 1, len(errs))
+	testutil.Equals(t, "domain example.com is defined in both testdata/conflict/a.yml and testdata/conflict/b.yml",
+		errs[0].Error())
+
+	_, errs = duplicateNames([]Domain{{Name: "example.com", Source: "a.yml"}, {Name: "example.com", Source: "a.yml"}})
+	testutil.Equals(t, 1, len(errs))
+	testutil.Equals(t, "domain example.com is defined more than once in a.yml", errs[0].Error())
+}
+
+func TestValidateDomainsFile(t *testing.T) {
+	resetEnvVars()
+	os.Setenv("CERTIFICATOR_DOMAINS_FILE", "testdata/invalid")
+	defer os.Setenv("CERTIFICATOR_DOMAINS_FILE", "../../domains.yml")
+
+	// Invalid names do not prevent loading, so that all problems are reported
+	conf, err := LoadDomainsConfig("")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(conf.Domains))
+
+	errs := ValidateDomains(conf.Domains, conf.MaxSANs, conf.CertificateLocation)
+	testutil.Equals(t, 4, len(errs), "errors: %v", errs)
+	testutil.Equals(t, "entry *.*.example.com (testdata/invalid/domains.yml): "+
+		"*.*.example.com: wildcard is allowed only as the whole leftmost label", errs[0].Error())
+}
@@ -0,0 +1,157 @@
+package vault
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Supported Vault authentication methods
+const (
+	AuthToken      = "token"
+	AuthTokenFile  = "token_file"
+	AuthAppRole    = "approle"
+	AuthKubernetes = "kubernetes"
+	AuthJWT        = "jwt"
+	AuthOIDC       = "oidc"
+	AuthCert       = "cert"
+	AuthUserpass   = "userpass"
+)
+
+// DefaultKubernetesTokenFile is location of service account token mounted into Kubernetes pods
+const DefaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Auth contains Vault authentication method and its credentials
+type Auth struct {
+	// Method is one of supported authentication methods
+	Method string
+	// Mount is path the auth method is enabled at, method name is used if it is empty
+	// (jwt for oidc, as JWTs are logged in non-interactively)
+	Mount string
+	// Role is role name of kubernetes and jwt/oidc methods, or optional certificate role name of cert method
+	Role string
+
+	// Token is used by token method
+	Token string
+	// TokenFile is read by token_file method, e.g. Vault Agent sink file
+	TokenFile string
+
+	RoleID   string
+	SecretID string
+
+	// JWT is used by jwt/oidc method, JWTFile is read if it is empty
+	JWT     string
+	JWTFile string
+	// KubernetesTokenFile is service account token file read by kubernetes method
+	KubernetesTokenFile string
+
+	// ClientCert and ClientKey are TLS client certificate and key files used by cert method
+	ClientCert string
+	ClientKey  string
+
+	Username string
+	Password string
+}
+
+// login authenticates client with the configured method and sets its token.
+// Auth secret is returned for methods that log in, token methods return nil
+func (a Auth) login(client *api.Client) (*api.Secret, error) {
+	switch a.Method {
+	case AuthToken:
+		// Client already uses VAULT_TOKEN if token is not configured
+		if a.Token != "" {
+			client.SetToken(a.Token)
+		}
+		if client.Token() == "" {
+			return nil, fmt.Errorf("vault token is not set")
+		}
+		return nil, nil
+	case AuthTokenFile:
+		token, err := readFile(a.TokenFile, "vault token")
+		if err != nil {
+			return nil, err
+		}
+		client.SetToken(token)
+		return nil, nil
+	case AuthAppRole:
+		return a.write(client, "login", map[string]interface{}{
+			"role_id":   a.RoleID,
+			"secret_id": a.SecretID,
+		})
+	case AuthKubernetes:
+		tokenFile := a.KubernetesTokenFile
+		if tokenFile == "" {
+			tokenFile = DefaultKubernetesTokenFile
+		}
+		jwt, err := readFile(tokenFile, "kubernetes service account token")
+		if err != nil {
+			return nil, err
+		}
+		return a.write(client, "login", map[string]interface{}{"role": a.Role, "jwt": jwt})
+	case AuthJWT, AuthOIDC:
+		jwt := a.JWT
+		if jwt == "" {
+			var err error
+			if jwt, err = readFile(a.JWTFile, "JWT"); err != nil {
+				return nil, err
+			}
+		}
+		return a.write(client, "login", map[string]interface{}{"role": a.Role, "jwt": jwt})
+	case AuthCert:
+		payload := map[string]interface{}{}
+		if a.Role != "" {
+			payload["name"] = a.Role
+		}
+		return a.write(client, "login", payload)
+	case AuthUserpass:
+		if a.Username == "" {
+			return nil, fmt.Errorf("vault username is not set")
+		}
+		return a.write(client, "login/"+a.Username, map[string]interface{}{"password": a.Password})
+	default:
+		return nil, fmt.Errorf("unsupported vault auth method %q", a.Method)
+	}
+}
+
+// write sends login request to path under auth method mount and sets token of the response
+func (a Auth) write(client *api.Client, path string, payload map[string]interface{}) (*api.Secret, error) {
+	mount := a.Mount
+	if mount == "" {
+		mount = a.Method
+		if mount == AuthOIDC {
+			mount = AuthJWT
+		}
+	}
+	loginPath := "auth/" + strings.Trim(mount, "/") + "/" + path
+
+	secret, err := client.Logical().Write(loginPath, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed logging in to vault at %s: %w", loginPath, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault login at %s returned no token", loginPath)
+	}
+	client.SetToken(secret.Auth.ClientToken)
+
+	return secret, nil
+}
+
+func readFile(path, description string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("%s file is not set", description)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", description, err)
+	}
+
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("%s file %s is empty", description, path)
+	}
+
+	return value, nil
+}
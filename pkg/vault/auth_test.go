@@ -0,0 +1,137 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestAuthLogin(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	testutil.Ok(t, os.WriteFile(tokenFile, []byte("agenttoken\n"), 0600))
+	jwtFile := filepath.Join(dir, "jwt")
+	testutil.Ok(t, os.WriteFile(jwtFile, []byte("serviceaccountjwt"), 0600))
+
+	var (
+		loginPath    string
+		loginPayload map[string]interface{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loginPath = r.URL.Path
+		loginPayload = nil
+		_ = json.NewDecoder(r.Body).Decode(&loginPayload)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "logintoken", "lease_duration": 3600, "renewable": true},
+		})
+	}))
+	defer srv.Close()
+
+	for _, tcase := range []struct {
+		name            string
+		auth            Auth
+		expectedToken   string
+		expectedPath    string
+		expectedPayload map[string]interface{}
+		err             bool
+	}{
+		{
+			name:          "token",
+			auth:          Auth{Method: AuthToken, Token: "statictoken"},
+			expectedToken: "statictoken",
+		},
+		{
+			name:          "token file",
+			auth:          Auth{Method: AuthTokenFile, TokenFile: tokenFile},
+			expectedToken: "agenttoken",
+		},
+		{
+			name: "missing token file",
+			auth: Auth{Method: AuthTokenFile, TokenFile: filepath.Join(dir, "missing")},
+			err:  true,
+		},
+		{
+			name:            "approle",
+			auth:            Auth{Method: AuthAppRole, RoleID: "role", SecretID: "secret"},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/approle/login",
+			expectedPayload: map[string]interface{}{"role_id": "role", "secret_id": "secret"},
+		},
+		{
+			name:            "approle custom mount",
+			auth:            Auth{Method: AuthAppRole, Mount: "/approle-certificator/", RoleID: "role"},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/approle-certificator/login",
+			expectedPayload: map[string]interface{}{"role_id": "role", "secret_id": ""},
+		},
+		{
+			name:            "kubernetes",
+			auth:            Auth{Method: AuthKubernetes, Role: "certificator", KubernetesTokenFile: jwtFile},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/kubernetes/login",
+			expectedPayload: map[string]interface{}{"role": "certificator", "jwt": "serviceaccountjwt"},
+		},
+		{
+			name:            "jwt",
+			auth:            Auth{Method: AuthJWT, Role: "certificator", JWT: "signedjwt"},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/jwt/login",
+			expectedPayload: map[string]interface{}{"role": "certificator", "jwt": "signedjwt"},
+		},
+		{
+			name:            "oidc from file",
+			auth:            Auth{Method: AuthOIDC, Role: "certificator", JWTFile: jwtFile},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/jwt/login",
+			expectedPayload: map[string]interface{}{"role": "certificator", "jwt": "serviceaccountjwt"},
+		},
+		{
+			name:            "cert",
+			auth:            Auth{Method: AuthCert, Role: "certificator"},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/cert/login",
+			expectedPayload: map[string]interface{}{"name": "certificator"},
+		},
+		{
+			name:            "userpass",
+			auth:            Auth{Method: AuthUserpass, Username: "certificator", Password: "pass"},
+			expectedToken:   "logintoken",
+			expectedPath:    "/v1/auth/userpass/login/certificator",
+			expectedPayload: map[string]interface{}{"password": "pass"},
+		},
+		{
+			name: "unknown",
+			auth: Auth{Method: "github"},
+			err:  true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			config := api.DefaultConfig()
+			config.Address = srv.URL
+			client, err := api.NewClient(config)
+			testutil.Ok(t, err)
+			client.ClearToken()
+			loginPath, loginPayload = "", nil
+
+			_, err = tcase.auth.login(client)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedToken, client.Token())
+			testutil.Equals(t, tcase.expectedPath, loginPath)
+			if tcase.expectedPayload != nil {
+				testutil.Equals(t, tcase.expectedPayload, loginPayload)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// kvStorage is location in KV secrets engine mount certificator stores its data at
+type kvStorage struct {
+	// mount is mount path with trailing slash, e.g. secret/
+	mount string
+	// version is KV secrets engine version, 1 or 2
+	version int
+	// prefix is storage path relative to mount, e.g. certificator/
+	prefix string
+}
+
+// dataPath returns API path of secret data
+func (s kvStorage) dataPath(path string) string {
+	if s.version == 2 {
+		return s.mount + "data/" + s.prefix + path
+	}
+
+	return s.mount + s.prefix + path
+}
+
+// metadataPath returns API path of secret metadata, KV v1 secrets have no metadata
+func (s kvStorage) metadataPath(path string) string {
+	if s.version == 2 {
+		return s.mount + "metadata/" + s.prefix + path
+	}
+
+	return s.mount + s.prefix + path
+}
+
+// newKVStorage splits storage path into KV mount and path relative to it.
+// Legacy KV v2 storage paths that include data/ segment, e.g. secret/data/certificator/, are accepted too
+func newKVStorage(storagePath string, mount string, version int) kvStorage {
+	storagePath = strings.TrimPrefix(storagePath, "/")
+	mount = strings.Trim(mount, "/")
+	if mount != "" {
+		mount += "/"
+	}
+
+	prefix := strings.TrimPrefix(storagePath, mount)
+	if version == 2 {
+		prefix = strings.TrimPrefix(prefix, "data/")
+	}
+
+	return kvStorage{mount: mount, version: version, prefix: prefix}
+}
+
+// detectKVStorage looks up KV secrets engine mount of storage path and its version.
+// Vault versions that do not know KV v2 have no such API, then storage path is used as is with KV v1
+func (cl *VaultClient) detectKVStorage(storagePath string) (kvStorage, error) {
+	var resp *api.Secret
+	err := cl.retry(func() (err error) {
+		resp, err = cl.client.Logical().Read("sys/internal/ui/mounts/" + strings.TrimPrefix(storagePath, "/"))
+		return err
+	})
+	if err != nil {
+		return kvStorage{}, fmt.Errorf("failed looking up KV mount of %s: %w", storagePath, err)
+	}
+	if resp == nil {
+		cl.logger.Warnf("vault does not report KV mount of %s, assuming KV version 1", storagePath)
+		return newKVStorage(storagePath, "", 1), nil
+	}
+
+	mount, _ := resp.Data["path"].(string)
+	if mount == "" {
+		return kvStorage{}, fmt.Errorf("%s is not in a vault secrets engine mount", storagePath)
+	}
+	if mountType, _ := resp.Data["type"].(string); mountType != "kv" && mountType != "generic" {
+		return kvStorage{}, fmt.Errorf("%s is in %s secrets engine mount %s, not KV", storagePath, mountType, mount)
+	}
+
+	version := 1
+	if options, ok := resp.Data["options"].(map[string]interface{}); ok && options["version"] == "2" {
+		version = 2
+	}
+
+	storage := newKVStorage(storagePath, mount, version)
+	cl.logger.Debugf("using KV version %d mount %s, storage path %s", version, storage.mount, storage.prefix)
+
+	return storage, nil
+}
+
+// ErrVersionConflict is returned by check-and-set writes if secret version changed since it was read
+var ErrVersionConflict = errors.New("secret was changed since its version was read")
+
+// KVVersion is metadata of KV v2 secret version
+type KVVersion struct {
+	Version     int
+	CreatedTime time.Time
+	Deleted     bool
+	Destroyed   bool
+}
+
+// KVWriteCAS writes value to vault key value storage only if the current secret version is cas,
+// 0 means that secret must not exist. ErrVersionConflict is returned if it does not match.
+// Written version is returned. KV v1 has no versions, value is written unconditionally and 0 is returned
+func (cl *VaultClient) KVWriteCAS(path string, value map[string]string, cas int) (int, error) {
+	return cl.write(path, value, map[string]interface{}{"cas": cas})
+}
+
+// KVReadVersion reads data from vault key value storage along with its current version.
+// Version is 0 if secret does not exist or storage is KV v1, data is nil if the current version is deleted
+func (cl *VaultClient) KVReadVersion(path string) (map[string]interface{}, int, error) {
+	return cl.read(path, nil)
+}
+
+// KVReadAt reads the given version of data from vault key value v2 storage,
+// nil is returned if the version is deleted or destroyed
+func (cl *VaultClient) KVReadAt(path string, version int) (map[string]interface{}, error) {
+	if cl.kv.version != 2 {
+		return nil, fmt.Errorf("KV version 1 storage keeps no secret versions")
+	}
+
+	value, _, err := cl.read(path, map[string][]string{"version": {strconv.Itoa(version)}})
+
+	return value, err
+}
+
+// KVVersions returns versions of secret in vault key value v2 storage ordered from the oldest one
+// and the current version. No versions are returned if secret does not exist
+func (cl *VaultClient) KVVersions(path string) ([]KVVersion, int, error) {
+	if cl.kv.version != 2 {
+		return nil, 0, fmt.Errorf("KV version 1 storage keeps no secret versions")
+	}
+
+	metadata, err := cl.KVReadMetadata(path)
+	if err != nil || metadata == nil {
+		return nil, 0, err
+	}
+
+	rawVersions, _ := metadata["versions"].(map[string]interface{})
+	versions := make([]KVVersion, 0, len(rawVersions))
+	for key, raw := range rawVersions {
+		number, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid version %q of vault path %s", key, path)
+		}
+
+		version := KVVersion{Version: number}
+		if raw, ok := raw.(map[string]interface{}); ok {
+			version.CreatedTime = parseTime(raw["created_time"])
+			version.Deleted = !parseTime(raw["deletion_time"]).IsZero()
+			version.Destroyed, _ = raw["destroyed"].(bool)
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	return versions, secretVersion(metadata["current_version"]), nil
+}
+
+// isVersionConflict checks if Vault rejected write because check-and-set version did not match
+func isVersionConflict(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	for _, message := range respErr.Errors {
+		if strings.Contains(message, "check-and-set") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// secretVersion converts version number of Vault response, 0 is returned if it is missing
+func secretVersion(value interface{}) int {
+	switch value := value.(type) {
+	case json.Number:
+		version, _ := value.Int64()
+		return int(version)
+	case float64:
+		return int(value)
+	}
+
+	return 0
+}
+
+// parseTime parses RFC 3339 time of Vault response, zero time is returned if it is missing or empty
+func parseTime(value interface{}) time.Time {
+	text, _ := value.(string)
+	parsed, _ := time.Parse(time.RFC3339Nano, text)
+
+	return parsed
+}
+
+// KVWriteMetadata sets custom metadata of secret in vault key value v2 storage, replacing the previous one.
+// Custom metadata requires Vault 1.9 or newer. KV v1 secrets have no metadata, nothing is written for them
+func (cl *VaultClient) KVWriteMetadata(path string, custom map[string]string) error {
+	if cl.kv.version != 2 {
+		cl.logger.Debugf("not writing metadata of %s, KV version 1 storage keeps no metadata", path)
+		return nil
+	}
+
+	fullPath := cl.kv.metadataPath(path)
+	cl.logger.Infof("Writing to vault metadata path %s", fullPath)
+	payload := map[string]interface{}{"custom_metadata": custom}
+	err := cl.retry(func() (err error) {
+		_, err = cl.client.Logical().Write(fullPath, payload)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed storing KV metadata to Vault at path: %s, error: %s", fullPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// writeKVMount writes response of KV mount lookup API
+func writeKVMount(w http.ResponseWriter, mount string, version int) {
+	options := map[string]interface{}{}
+	if version == 2 {
+		options["version"] = "2"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]interface{}{"path": mount, "type": "kv", "options": options},
+	})
+}
+
+func TestNewKVStorage(t *testing.T) {
+	for _, tcase := range []struct {
+		name             string
+		storagePath      string
+		mount            string
+		version          int
+		expectedData     string
+		expectedMetadata string
+	}{
+		{
+			name:             "kv v2",
+			storagePath:      "secret/certificator/",
+			mount:            "secret/",
+			version:          2,
+			expectedData:     "secret/data/certificator/certificates/example.com",
+			expectedMetadata: "secret/metadata/certificator/certificates/example.com",
+		},
+		{
+			name:             "legacy kv v2 path",
+			storagePath:      "/secret/data/certificator/",
+			mount:            "secret/",
+			version:          2,
+			expectedData:     "secret/data/certificator/certificates/example.com",
+			expectedMetadata: "secret/metadata/certificator/certificates/example.com",
+		},
+		{
+			name:             "kv v2 nested mount",
+			storagePath:      "team/kv/certificator/",
+			mount:            "team/kv/",
+			version:          2,
+			expectedData:     "team/kv/data/certificator/certificates/example.com",
+			expectedMetadata: "team/kv/metadata/certificator/certificates/example.com",
+		},
+		{
+			name:             "kv v1",
+			storagePath:      "secret/data/certificator/",
+			mount:            "secret/",
+			version:          1,
+			expectedData:     "secret/data/certificator/certificates/example.com",
+			expectedMetadata: "secret/data/certificator/certificates/example.com",
+		},
+		{
+			name:             "unknown mount",
+			storagePath:      "kv/certificator/",
+			version:          1,
+			expectedData:     "kv/certificator/certificates/example.com",
+			expectedMetadata: "kv/certificator/certificates/example.com",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			storage := newKVStorage(tcase.storagePath, tcase.mount, tcase.version)
+			testutil.Equals(t, tcase.expectedData, storage.dataPath("certificates/example.com"))
+			testutil.Equals(t, tcase.expectedMetadata, storage.metadataPath("certificates/example.com"))
+		})
+	}
+}
+
+func TestKVReadWrite(t *testing.T) {
+	for _, tcase := range []struct {
+		name         string
+		version      int
+		dataPath     string
+		expectedBody map[string]interface{}
+	}{
+		{
+			name:         "kv v1",
+			version:      1,
+			dataPath:     "/v1/kv/certificator/test",
+			expectedBody: map[string]interface{}{"key": "value"},
+		},
+		{
+			name:         "kv v2",
+			version:      2,
+			dataPath:     "/v1/kv/data/certificator/test",
+			expectedBody: map[string]interface{}{"data": map[string]interface{}{"key": "value"}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var stored map[string]interface{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/v1/sys/internal/ui/mounts/kv/certificator":
+					writeKVMount(w, "kv/", tcase.version)
+				case r.URL.Path == tcase.dataPath && r.Method == http.MethodPut:
+					testutil.Ok(t, json.NewDecoder(r.Body).Decode(&stored))
+					w.WriteHeader(http.StatusNoContent)
+				case r.URL.Path == tcase.dataPath && r.Method == http.MethodGet:
+					_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": stored})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+			setenv(t, "VAULT_ADDR", srv.URL)
+
+			client, err := NewVaultClientWithAuth(Auth{Method: AuthToken, Token: "token"}, "kv/certificator/",
+				logrus.New())
+			testutil.Ok(t, err)
+			defer client.Close()
+
+			testutil.Ok(t, client.KVWrite("test", map[string]string{"key": "value"}))
+			testutil.Equals(t, tcase.expectedBody, stored)
+
+			value, err := client.KVRead("test")
+			testutil.Ok(t, err)
+			testutil.Equals(t, map[string]interface{}{"key": "value"}, value)
+		})
+	}
+}
+
+func TestKVCheckAndSet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/sys/internal/ui/mounts/kv/certificator":
+			writeKVMount(w, "kv/", 2)
+		case r.URL.Path == "/v1/kv/data/certificator/test" && r.Method == http.MethodGet:
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"key": "value"},
+				"metadata": map[string]interface{}{"version": 3},
+			}})
+		case r.URL.Path == "/v1/kv/data/certificator/test" && r.Method == http.MethodPut:
+			var payload struct {
+				Options struct {
+					CAS int `json:"cas"`
+				} `json:"options"`
+			}
+			testutil.Ok(t, json.NewDecoder(r.Body).Decode(&payload))
+			if payload.Options.CAS != 3 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": 4}})
+		case r.URL.Path == "/v1/kv/metadata/certificator/test":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"current_version": 3,
+				"versions": map[string]interface{}{
+					"3": map[string]interface{}{"created_time": "2021-03-01T00:00:00Z", "deletion_time": ""},
+					"1": map[string]interface{}{"created_time": "2021-01-01T00:00:00Z", "destroyed": true},
+					"2": map[string]interface{}{"created_time": "2021-02-01T00:00:00Z",
+						"deletion_time": "2021-02-02T00:00:00Z"},
+				},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	setenv(t, "VAULT_ADDR", srv.URL)
+
+	client, err := NewVaultClientWithAuth(Auth{Method: AuthToken, Token: "token"}, "kv/certificator/", logrus.New())
+	testutil.Ok(t, err)
+	defer client.Close()
+
+	value, version, err := client.KVReadVersion("test")
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]interface{}{"key": "value"}, value)
+	testutil.Equals(t, 3, version)
+
+	written, err := client.KVWriteCAS("test", map[string]string{"key": "new"}, version)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, written)
+
+	_, err = client.KVWriteCAS("test", map[string]string{"key": "new"}, 2)
+	testutil.Assert(t, errors.Is(err, ErrVersionConflict), "stale version should conflict, got %v", err)
+
+	versions, current, err := client.KVVersions("test")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, current)
+	testutil.Equals(t, []KVVersion{
+		{Version: 1, CreatedTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Destroyed: true},
+		{Version: 2, CreatedTime: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), Deleted: true},
+		{Version: 3, CreatedTime: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}, versions)
+}
+
+func TestKVWriteMetadata(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		version  int
+		expected map[string]interface{}
+	}{
+		{
+			name:     "kv v2",
+			version:  2,
+			expected: map[string]interface{}{"custom_metadata": map[string]interface{}{"serial": "abcdef"}},
+		},
+		{name: "kv v1", version: 1},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var written map[string]interface{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/v1/sys/internal/ui/mounts/kv/certificator":
+					writeKVMount(w, "kv/", tcase.version)
+				case r.URL.Path == "/v1/kv/metadata/certificator/test" && r.Method == http.MethodPut:
+					testutil.Ok(t, json.NewDecoder(r.Body).Decode(&written))
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+			setenv(t, "VAULT_ADDR", srv.URL)
+
+			client, err := NewVaultClientWithAuth(Auth{Method: AuthToken, Token: "token"}, "kv/certificator/",
+				logrus.New())
+			testutil.Ok(t, err)
+			defer client.Close()
+
+			testutil.Ok(t, client.KVWriteMetadata("test", map[string]string{"serial": "abcdef"}))
+			testutil.Equals(t, tcase.expected, written)
+		})
+	}
+}
+
+func TestKVList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/sys/internal/ui/mounts/kv/certificator":
+			writeKVMount(w, "kv/", 2)
+		case r.URL.Path == "/v1/kv/metadata/certificator/accounts" && r.URL.Query().Get("list") == "true":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"keys": []string{"old@test.com/", "new@test.com/"},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	setenv(t, "VAULT_ADDR", srv.URL)
+
+	client, err := NewVaultClientWithAuth(Auth{Method: AuthToken, Token: "token"}, "kv/certificator/", logrus.New())
+	testutil.Ok(t, err)
+	defer client.Close()
+
+	keys, err := client.KVList("accounts/")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"old@test.com/", "new@test.com/"}, keys)
+
+	keys, err = client.KVList("missing/")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(keys))
+}
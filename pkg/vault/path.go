@@ -0,0 +1,90 @@
+package vault
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathVariables are values substituted into path template placeholders:
+// {domain}, {reversed_domain}, {group} and {environment}
+type PathVariables struct {
+	Domain      string
+	Group       string
+	Environment string
+}
+
+// RenderPath replaces placeholders of path template with encoded variables,
+// e.g. certificates/{environment}/{reversed_domain} becomes certificates/prod/com.example._wildcard
+// for *.example.com domain in prod environment
+func RenderPath(template string, vars PathVariables) (string, error) {
+	domain := EncodePathSegment(vars.Domain)
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	values := map[string]string{
+		"domain":          domain,
+		"reversed_domain": strings.Join(labels, "."),
+		"group":           EncodePathSegment(vars.Group),
+		"environment":     EncodePathSegment(vars.Environment),
+	}
+
+	var path strings.Builder
+	for rest := template; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			path.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("path template %q has unclosed placeholder", template)
+		}
+
+		name := rest[start+1 : start+end]
+		value, ok := values[name]
+		if !ok {
+			return "", fmt.Errorf("path template %q has unknown placeholder {%s}", template, name)
+		}
+		if value == "" {
+			return "", fmt.Errorf("path template %q uses {%s}, but it is not set", template, name)
+		}
+
+		path.WriteString(rest[:start])
+		path.WriteString(value)
+		rest = rest[start+end+1:]
+	}
+
+	if path.Len() == 0 || strings.HasPrefix(path.String(), "/") {
+		return "", fmt.Errorf("path template %q must render to a relative path", template)
+	}
+
+	return path.String(), nil
+}
+
+// ValidatePathTemplate checks that path template has only known placeholders
+func ValidatePathTemplate(template string) error {
+	_, err := RenderPath(template, PathVariables{Domain: "example.com", Group: "group", Environment: "env"})
+	return err
+}
+
+// EncodePathSegment makes value safe to use as a single segment of Vault path.
+// Wildcard label * is replaced with _wildcard, other characters except letters, digits, dot,
+// hyphen and underscore are replaced with underscore followed by their hex code, e.g. / becomes _2f
+func EncodePathSegment(value string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '*':
+			encoded.WriteString("_wildcard")
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "_%02x", c)
+		}
+	}
+
+	return encoded.String()
+}
@@ -0,0 +1,63 @@
+package vault
+
+import (
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestRenderPath(t *testing.T) {
+	vars := PathVariables{Domain: "www.example.com", Group: "team-a", Environment: "prod"}
+
+	for _, tcase := range []struct {
+		template string
+		vars     PathVariables
+		expected string
+		err      bool
+	}{
+		{template: "certificates/{domain}", vars: vars, expected: "certificates/www.example.com"},
+		{template: "certificates/{reversed_domain}", vars: vars, expected: "certificates/com.example.www"},
+		{
+			template: "{environment}/{group}/certs/{domain}",
+			vars:     vars,
+			expected: "prod/team-a/certs/www.example.com",
+		},
+		{
+			template: "certificates/{domain}",
+			vars:     PathVariables{Domain: "*.example.com"},
+			expected: "certificates/_wildcard.example.com",
+		},
+		{
+			template: "certificates/{reversed_domain}",
+			vars:     PathVariables{Domain: "*.example.com"},
+			expected: "certificates/com.example._wildcard",
+		},
+		{
+			template: "{group}/{domain}",
+			vars:     PathVariables{Domain: "example.com", Group: "team/a"},
+			expected: "team_2fa/example.com",
+		},
+		{template: "certificates", vars: vars, expected: "certificates"},
+		{template: "certificates/{host}", vars: vars, err: true},
+		{template: "certificates/{domain", vars: vars, err: true},
+		{template: "{group}/{domain}", vars: PathVariables{Domain: "example.com"}, err: true},
+		{template: "/certificates/{domain}", vars: vars, err: true},
+		{template: "", vars: vars, err: true},
+	} {
+		t.Run(tcase.template, func(t *testing.T) {
+			path, err := RenderPath(tcase.template, tcase.vars)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, path)
+		})
+	}
+}
+
+func TestEncodePathSegment(t *testing.T) {
+	testutil.Equals(t, "_wildcard.example.com", EncodePathSegment("*.example.com"))
+	testutil.Equals(t, "xn--bcher-kva.example", EncodePathSegment("xn--bcher-kva.example"))
+	testutil.Equals(t, "a_20b_2fc_25", EncodePathSegment("a b/c%"))
+}
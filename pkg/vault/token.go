@@ -0,0 +1,151 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// watchToken renews client token in background for as long as Vault allows.
+// When token can no longer be renewed, or client logs in again after a denied request,
+// the new token is watched instead. Tokens without TTL, e.g. root ones, are not watched
+func (cl *VaultClient) watchToken() {
+	for {
+		token := cl.client.Token()
+		watcher, err := cl.tokenWatcher()
+		if err != nil {
+			cl.logger.Warnf("vault token will not be renewed: %s", err)
+			return
+		}
+		if watcher == nil {
+			return
+		}
+		go watcher.Start()
+
+		if stopped := cl.waitToken(watcher); stopped {
+			return
+		}
+
+		if err := cl.relogin(token); err != nil {
+			cl.logger.Errorf("failed logging in to vault again: %s", err)
+			return
+		}
+		// Own login does not need to restart the watcher
+		select {
+		case <-cl.loggedIn:
+		default:
+		}
+		if cl.client.Token() == token {
+			cl.logger.Warnf("vault token can not be renewed or replaced, it will expire")
+			return
+		}
+	}
+}
+
+// waitToken logs token renewals until watcher is done, client logs in again or it is closed.
+// True is returned if client is closed
+func (cl *VaultClient) waitToken(watcher *api.LifetimeWatcher) bool {
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-cl.done:
+			return true
+		case <-cl.loggedIn:
+			return false
+		case renewal := <-watcher.RenewCh():
+			cl.logger.Debugf("renewed vault token at %s", renewal.RenewedAt)
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				cl.logger.Warnf("failed renewing vault token: %s", err)
+			}
+			return false
+		}
+	}
+}
+
+// tokenWatcher creates lifetime watcher of current client token, nil is returned if token does not expire.
+// Token is looked up if it was not obtained by logging in
+func (cl *VaultClient) tokenWatcher() (*api.LifetimeWatcher, error) {
+	cl.mu.Lock()
+	secret := cl.secret
+	cl.mu.Unlock()
+
+	if secret == nil || secret.Auth == nil {
+		var err error
+		secret, err = cl.client.Auth().Token().LookupSelf()
+		if err != nil {
+			return nil, fmt.Errorf("looking up token: %w", err)
+		}
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil || ttl <= 0 {
+		return nil, err
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	cl.logger.Debugf("watching vault token with TTL %s, renewable: %t", ttl, renewable)
+
+	return cl.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: &api.Secret{Auth: &api.SecretAuth{
+		ClientToken:   cl.client.Token(),
+		Renewable:     renewable,
+		LeaseDuration: int(ttl.Seconds()),
+	}}})
+}
+
+// relogin logs in again, unless client token is no longer the denied one,
+// which means that it was already replaced concurrently
+func (cl *VaultClient) relogin(denied string) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.client.Token() != denied {
+		return nil
+	}
+
+	cl.logger.Infof("logging in to vault again with %s method", cl.auth.Method)
+	secret, err := cl.auth.login(cl.client)
+	if err != nil {
+		return err
+	}
+	cl.secret = secret
+
+	select {
+	case cl.loggedIn <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// retry calls request and, if Vault denies it, logs in again and calls it once more.
+// Expired token is denied with 403 status
+func (cl *VaultClient) retry(request func() error) error {
+	token := cl.client.Token()
+	err := request()
+
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusForbidden {
+		return err
+	}
+
+	cl.logger.Warnf("vault denied request, logging in again: %s", err)
+	if loginErr := cl.relogin(token); loginErr != nil {
+		return fmt.Errorf("%w, logging in again failed: %v", err, loginErr)
+	}
+	if cl.client.Token() == token {
+		return err
+	}
+
+	return request()
+}
+
+// Close stops renewing client token
+func (cl *VaultClient) Close() {
+	cl.closeOnce.Do(func() { close(cl.done) })
+}
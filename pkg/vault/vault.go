@@ -3,77 +3,236 @@ package vault
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/sirupsen/logrus"
 )
 
 type VaultClient struct {
-	client   *api.Client
-	kvPrefix string
-	logger   *logrus.Logger
+	client *api.Client
+	auth   Auth
+	kv     kvStorage
+	logger *logrus.Logger
+
+	// mu guards logging in and secret, which is the latest login response
+	mu       sync.Mutex
+	secret   *api.Secret
+	loggedIn chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewClient initializes vault client with default configuration.
 // It authenticates using approle method (or uses provided token in dev) and returns.
-func NewVaultClient(roleID, secretID, env, kvPrefix string, logger *logrus.Logger) (*VaultClient, error) {
-	client, err := api.NewClient(api.DefaultConfig())
-	if err != nil {
-		return nil, err
+func NewVaultClient(roleID, secretID, env, kvPath string, logger *logrus.Logger) (*VaultClient, error) {
+	auth := Auth{Method: AuthAppRole, RoleID: roleID, SecretID: secretID}
+	if env == "dev" {
+		auth = Auth{Method: AuthToken, Token: os.Getenv("VAULT_DEV_ROOT_TOKEN_ID")}
 	}
 
-	if env == "dev" {
-		client.SetToken(os.Getenv("VAULT_DEV_ROOT_TOKEN_ID"))
-	} else {
-		payload := map[string]interface{}{"role_id": roleID,
-			"secret_id": secretID}
-		resp, err := client.Logical().Write("auth/approle/login", payload)
-		if err != nil {
+	return NewVaultClientWithAuth(auth, kvPath, logger)
+}
+
+// NewVaultClientWithAuth initializes vault client with default configuration
+// and authenticates using the given auth method. KV secrets engine mount of kvPath and its version are detected,
+// data is stored under kvPath in the mount.
+// Token is renewed in background until Close is called, client logs in again once it can not be renewed
+func NewVaultClientWithAuth(auth Auth, kvPath string, logger *logrus.Logger) (*VaultClient, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+	if auth.ClientCert != "" {
+		if err := config.ConfigureTLS(&api.TLSConfig{ClientCert: auth.ClientCert, ClientKey: auth.ClientKey}); err != nil {
 			return nil, err
 		}
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("authenticating to vault with %s method", auth.Method)
+	secret, err := auth.login(client)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &VaultClient{
+		client:   client,
+		auth:     auth,
+		logger:   logger,
+		secret:   secret,
+		loggedIn: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go cl.watchToken()
 
-		client.SetToken(resp.Auth.ClientToken)
+	if cl.kv, err = cl.detectKVStorage(kvPath); err != nil {
+		cl.Close()
+		return nil, err
 	}
 
-	return &VaultClient{client: client, kvPrefix: kvPrefix, logger: logger}, nil
+	return cl, nil
 }
 
-// KVWrite writes value to vault key value v2 storage
+// KVWrite writes value to vault key value storage, overwriting the current version
 func (cl *VaultClient) KVWrite(path string, value map[string]string) error {
-	fullPath := vaultFullPath(path, cl.kvPrefix)
+	_, err := cl.write(path, value, nil)
+
+	return err
+}
+
+// write writes value with KV v2 options and returns the written version, which is 0 for KV v1
+func (cl *VaultClient) write(path string, value map[string]string, options map[string]interface{}) (int, error) {
+	fullPath := cl.kv.dataPath(path)
 	cl.logger.Infof("Writing to vault path %s", fullPath)
-	payload := map[string]interface{}{"data": value}
-	resp, err := cl.client.Logical().Write(fullPath, payload)
+	payload := make(map[string]interface{}, len(value))
+	for key, val := range value {
+		payload[key] = val
+	}
+	if cl.kv.version == 2 {
+		payload = map[string]interface{}{"data": payload}
+		if options != nil {
+			payload["options"] = options
+		}
+	}
+
+	var resp *api.Secret
+	err := cl.retry(func() (err error) {
+		resp, err = cl.client.Logical().Write(fullPath, payload)
+		return err
+	})
+	if isVersionConflict(err) {
+		return 0, fmt.Errorf("failed storing KV value to Vault at path: %s: %w", fullPath, ErrVersionConflict)
+	}
 	if err != nil {
 		err = fmt.Errorf("failed storing KV value to Vault, got: %v, error: %s", resp, err)
-		return err
+		return 0, err
 	}
 
-	return nil
+	if cl.kv.version != 2 || resp == nil {
+		return 0, nil
+	}
+	version := secretVersion(resp.Data["version"])
+	cl.logger.Infof("wrote version %d of vault path %s", version, fullPath)
+
+	return version, nil
 }
 
 // KVRead reads data from vault key value storage
 func (cl *VaultClient) KVRead(path string) (map[string]interface{}, error) {
-	fullPath := vaultFullPath(path, cl.kvPrefix)
+	value, _, err := cl.read(path, nil)
+
+	return value, err
+}
+
+// read reads data with the given parameters and returns it along with its KV v2 version.
+// Data of deleted KV v2 version is nil, but its version is returned
+func (cl *VaultClient) read(path string, params map[string][]string) (map[string]interface{}, int, error) {
+	fullPath := cl.kv.dataPath(path)
 	cl.logger.Infof("reading Vault path: %s", fullPath)
-	resp, err := cl.client.Logical().Read(fullPath)
+	var resp *api.Secret
+	err := cl.retry(func() (err error) {
+		resp, err = cl.client.Logical().ReadWithData(fullPath, params)
+		return err
+	})
 	if err != nil {
 		err = fmt.Errorf("failed reading KV from Vault at path: %s, got: %v, error: %s",
 			fullPath, resp, err)
-		return nil, err
+		return nil, 0, err
 	}
 
 	if resp == nil {
-		return nil, nil
+		return nil, 0, nil
 	}
 
+	if cl.kv.version != 2 {
+		return resp.Data, 0, nil
+	}
+
+	var version int
+	if metadata, ok := resp.Data["metadata"].(map[string]interface{}); ok {
+		version = secretVersion(metadata["version"])
+	}
 	if value, ok := resp.Data["data"].(map[string]interface{}); ok {
-		return value, nil
+		return value, version, nil
+	}
+
+	return nil, version, nil
+}
+
+// KVReadMetadata reads metadata of secret in vault key value storage, e.g. its versions.
+// KV v1 secrets have no metadata, nil is returned for them
+func (cl *VaultClient) KVReadMetadata(path string) (map[string]interface{}, error) {
+	if cl.kv.version != 2 {
+		return nil, nil
+	}
+
+	fullPath := cl.kv.metadataPath(path)
+	cl.logger.Infof("reading Vault metadata path: %s", fullPath)
+	var resp *api.Secret
+	err := cl.retry(func() (err error) {
+		resp, err = cl.client.Logical().Read(fullPath)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed reading KV metadata from Vault at path: %s, error: %s", fullPath, err)
+	}
+
+	if resp == nil {
+		return nil, nil
+	}
+
+	return resp.Data, nil
+}
+
+// KVList lists keys under path in vault key value storage, keys of subpaths end with a slash.
+// No keys are returned if path does not exist
+func (cl *VaultClient) KVList(path string) ([]string, error) {
+	fullPath := cl.kv.metadataPath(path)
+	cl.logger.Infof("listing Vault path: %s", fullPath)
+	var resp *api.Secret
+	err := cl.retry(func() (err error) {
+		resp, err = cl.client.Logical().List(fullPath)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed listing KV in Vault at path: %s, error: %s", fullPath, err)
 	}
 
-	return nil, nil
+	if resp == nil {
+		return nil, nil
+	}
+
+	rawKeys, _ := resp.Data["keys"].([]interface{})
+	keys := make([]string, 0, len(rawKeys))
+	for _, key := range rawKeys {
+		if key, ok := key.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
 }
 
-func vaultFullPath(path string, prefix string) string {
-	return prefix + path
+// KVDelete deletes data in vault key value storage, only the latest version is deleted in KV v2
+func (cl *VaultClient) KVDelete(path string) error {
+	fullPath := cl.kv.dataPath(path)
+	cl.logger.Infof("deleting Vault path: %s", fullPath)
+	var resp *api.Secret
+	err := cl.retry(func() (err error) {
+		resp, err = cl.client.Logical().Delete(fullPath)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("failed deleting KV from Vault at path: %s, got: %v, error: %s",
+			fullPath, resp, err)
+		return err
+	}
+
+	return nil
 }
@@ -7,8 +7,11 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -67,6 +70,10 @@ func TestNewVaultClient(t *testing.T) {
 		}
 	})
 
+	smux.PathPrefix("/v1/sys/internal/ui/mounts/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeKVMount(w, "testPrefix/", 2)
+	})
+
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	testutil.Ok(t, err)
 
@@ -101,3 +108,95 @@ func TestNewVaultClient(t *testing.T) {
 		})
 	}
 }
+
+// newTokenTestServer serves approle logins, which return tokens token-1, token-2, etc. with leaseDuration,
+// and KV reads, which are denied for tokens other than the valid one
+func newTokenTestServer(t *testing.T, leaseDuration int, valid func() string) (*httptest.Server, *int32) {
+	var logins int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			token := fmt.Sprintf("token-%d", atomic.AddInt32(&logins, 1))
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+				"client_token": token, "lease_duration": leaseDuration, "renewable": false,
+			}})
+		case "/v1/sys/internal/ui/mounts/secret/data":
+			writeKVMount(w, "secret/", 2)
+		case "/v1/secret/data/test":
+			if r.Header.Get("X-Vault-Token") != valid() {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"data": map[string]interface{}{"key": "value"}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &logins
+}
+
+func TestVaultClientRetriesDeniedRequest(t *testing.T) {
+	srv, logins := newTokenTestServer(t, 0, func() string { return "token-2" })
+	setenv(t, "VAULT_ADDR", srv.URL)
+
+	client, err := NewVaultClientWithAuth(Auth{Method: AuthAppRole, RoleID: "role"}, "secret/data/", logrus.New())
+	testutil.Ok(t, err)
+	defer client.Close()
+	testutil.Equals(t, "token-1", client.client.Token())
+
+	value, err := client.KVRead("test")
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]interface{}{"key": "value"}, value)
+	testutil.Equals(t, int32(2), atomic.LoadInt32(logins))
+
+	// Request is retried only once
+	srv, logins = newTokenTestServer(t, 0, func() string { return "" })
+	setenv(t, "VAULT_ADDR", srv.URL)
+
+	client, err = NewVaultClientWithAuth(Auth{Method: AuthAppRole, RoleID: "role"}, "secret/data/", logrus.New())
+	testutil.Ok(t, err)
+	defer client.Close()
+
+	_, err = client.KVRead("test")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, int32(2), atomic.LoadInt32(logins))
+}
+
+func TestVaultClientLogsInBeforeTokenExpires(t *testing.T) {
+	srv, logins := newTokenTestServer(t, 1, func() string { return "" })
+	setenv(t, "VAULT_ADDR", srv.URL)
+
+	client, err := NewVaultClientWithAuth(Auth{Method: AuthAppRole, RoleID: "role"}, "secret/data/", logrus.New())
+	testutil.Ok(t, err)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(logins) < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	testutil.Assert(t, atomic.LoadInt32(logins) >= 3, "client should log in again when token can not be renewed")
+
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+	closed := atomic.LoadInt32(logins)
+	time.Sleep(1500 * time.Millisecond)
+	testutil.Equals(t, closed, atomic.LoadInt32(logins))
+}
+
+// setenv sets environment variable for the duration of test
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	os.Setenv(key, value)
+}
@@ -0,0 +1,6 @@
+// Package version contains certificator version, which is set at build time, e.g.
+// go build -ldflags "-X github.com/vinted/certificator/pkg/version.Version=v1.2.3" ./cmd/certificator
+package version
+
+// Version is certificator version
+var Version = "dev"
@@ -2,10 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/hashicorp/vault/api"
 	"github.com/sirupsen/logrus"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -23,6 +29,12 @@ var (
 	keyEncoded    string
 	acmeEmail     string = "test@test.com"
 	acmeURL       string = "https://pebble:14000/dir"
+	accountPath   string = "accounts/pebble_14000_dir/test@test.com/"
+	dnsChallenge         = certificate.Challenge{
+		Type:         certificate.ChallengeDNS01,
+		DNSAddresses: []string{"challtestsrv:8053"},
+		DNSProvider:  certificate.DNSProvider{Provider: "exec"},
+	}
 )
 
 func TestMain(m *testing.M) {
@@ -56,17 +68,17 @@ func TestAcmeClientAndAccountSetup(t *testing.T) {
 	deleteKeyFromVault(t, testVaultClient)
 
 	// This populates data in Vault, account and key are both present
-	_, err = acme.NewClient(acmeEmail, acmeURL, true, vaultClient, logger)
+	_, err = acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
 	testutil.Ok(t, err)
 
 	// Save account and key data from first registration
-	account, err := vaultClient.KVRead("account")
+	account, err := vaultClient.KVRead(accountPath + "account")
 	testutil.Ok(t, err)
 	accountInfo, ok := account["account"].(string)
 	testutil.Equals(t, true, ok)
 	testutil.Ok(t, json.Unmarshal([]byte(accountInfo), &acc))
 
-	key, err := vaultClient.KVRead("key")
+	key, err := vaultClient.KVRead(accountPath + "key")
 	testutil.Ok(t, err)
 	keyEncoded, ok = key["pem"].(string)
 	testutil.Equals(t, true, ok)
@@ -121,18 +133,18 @@ func TestAcmeClientAndAccountSetup(t *testing.T) {
 				jsonAccount, err := json.Marshal(acc)
 				testutil.Ok(t, err)
 
-				err = vaultClient.KVWrite("account", map[string]string{"account": string(jsonAccount)})
+				err = vaultClient.KVWrite(accountPath+"account", map[string]string{"account": string(jsonAccount)})
 				testutil.Ok(t, err)
 			}
 
 			if !tcase.keyInVault {
 				deleteKeyFromVault(t, testVaultClient)
 			} else {
-				err = vaultClient.KVWrite("key", map[string]string{"pem": keyEncoded})
+				err = vaultClient.KVWrite(accountPath+"key", map[string]string{"pem": keyEncoded})
 				testutil.Ok(t, err)
 			}
 
-			_, err := acme.NewClient(acmeEmail, acmeURL, tcase.reregisteringEnabled, vaultClient, logger)
+			_, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, tcase.reregisteringEnabled, vaultClient, logger)
 			if tcase.expectedErr {
 				testutil.NotOk(t, err)
 			} else {
@@ -142,6 +154,44 @@ func TestAcmeClientAndAccountSetup(t *testing.T) {
 	}
 }
 
+func TestLegacyAccountMigration(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	testVaultClient, err := api.NewClient(api.DefaultConfig())
+	testutil.Ok(t, err)
+	testVaultClient.SetToken(vaultDevToken)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	// Register an account and move it to the flat layout used by previous versions
+	_, err = acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	account, err := vaultClient.KVRead(accountPath + "account")
+	testutil.Ok(t, err)
+	key, err := vaultClient.KVRead(accountPath + "key")
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, vaultClient.KVWrite("account", map[string]string{"account": account["account"].(string)}))
+	testutil.Ok(t, vaultClient.KVWrite("key", map[string]string{"pem": key["pem"].(string)}))
+	deleteAccountFromVault(t, testVaultClient)
+	deleteKeyFromVault(t, testVaultClient)
+
+	// Reregistering is disabled, so client can only be set up from migrated data
+	_, err = acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, false, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	migratedKey, err := vaultClient.KVRead(accountPath + "key")
+	testutil.Ok(t, err)
+	testutil.Equals(t, key["pem"], migratedKey["pem"])
+
+	legacyAccount, err := vaultClient.KVRead("account")
+	testutil.Ok(t, err)
+	testutil.Assert(t, legacyAccount == nil, "legacy account should be removed after migration")
+}
+
 func TestCertificateObtaining(t *testing.T) {
 	logger := logrus.New()
 	logger.SetLevel(logrus.WarnLevel)
@@ -149,30 +199,749 @@ func TestCertificateObtaining(t *testing.T) {
 	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
 	testutil.Ok(t, err)
 
-	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, true, vaultClient, logger)
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
 	testutil.Ok(t, err)
 
 	for _, domain := range []string{"example.com", "test.com", "mydomain.com"} {
-		err := certificate.ObtainCertificate(acmeClient, vaultClient, []string{domain},
-			"challtestsrv:8053", "exec", false)
+		err := certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+			Domains:   []string{domain},
+			KeyType:   certcrypto.RSA2048,
+			Challenge: dnsChallenge,
+		}, logrus.NewEntry(logger))
 		testutil.Ok(t, err)
 
-		cert, err := certificate.GetCertificate(domain, vaultClient)
+		cert, err := certificate.GetCertificate(certificate.VaultCertLocation(domain), vaultClient)
 		testutil.Ok(t, err)
 
 		// Check if certificate is issued recently
 		testutil.Assert(t, time.Since(cert.NotBefore).Minutes() < 5)
+
+		caURL, err := certificate.GetCertificateCA(certificate.VaultCertLocation(domain), vaultClient)
+		testutil.Ok(t, err)
+		testutil.Equals(t, acmeURL, caURL)
+
+		stored, err := certificate.ReadCertificate(certificate.VaultCertLocation(domain), vaultClient)
+		testutil.Ok(t, err)
+		testutil.Equals(t, cert.SerialNumber, stored.Certificate.SerialNumber)
+		testutil.Equals(t, acmeURL, stored.CAURL)
+
+		// Certificate is described by metadata, which can be read without private key
+		metadata, err := vaultClient.KVReadMetadata(certificate.VaultCertLocation(domain))
+		testutil.Ok(t, err)
+		custom, _ := metadata["custom_metadata"].(map[string]interface{})
+		testutil.Equals(t, fmt.Sprintf("%x", cert.SerialNumber), custom["serial"])
+		testutil.Equals(t, cert.NotAfter.UTC().Format(time.RFC3339), custom["not_after"])
+		testutil.Equals(t, domain, custom["sans"])
+		testutil.Equals(t, "RSA2048", custom["key_type"])
+		testutil.Equals(t, acmeURL, custom["ca_url"])
+	}
+}
+
+func TestCertificateKeyType(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	domains := []string{"keytype.com"}
+	for _, keyType := range []certcrypto.KeyType{certcrypto.EC256, certcrypto.RSA2048} {
+		err := certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+			Domains:   domains,
+			KeyType:   keyType,
+			Challenge: dnsChallenge,
+		}, logrus.NewEntry(logger))
+		testutil.Ok(t, err)
+
+		cert, err := certificate.GetCertificate(certificate.VaultCertLocation(domains[0]), vaultClient)
+		testutil.Ok(t, err)
+
+		needsReissuing, err := certificate.NeedsReissuing(cert, domains, keyType, nil, 30, logger)
+		testutil.Ok(t, err)
+		testutil.Equals(t, false, needsReissuing)
+	}
+}
+
+func TestRenewalInformation(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	domains := []string{"ari.com"}
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   domains,
+		KeyType:   certcrypto.RSA2048,
+		Challenge: dnsChallenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	cert, err := certificate.GetCertificate(certificate.VaultCertLocation(domains[0]), vaultClient)
+	testutil.Ok(t, err)
+
+	renewalInfo, err := acmeClient.GetRenewalInfo(cert)
+	testutil.Ok(t, err)
+	testutil.Assert(t, renewalInfo != nil, "pebble should provide renewal information")
+	testutil.Assert(t, renewalInfo.SuggestedWindow.Start.Before(cert.NotAfter))
+
+	// Replacement order is accepted by CA and new certificate is stored
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   domains,
+		KeyType:   certcrypto.RSA2048,
+		Replaces:  renewalInfo.CertID,
+		Challenge: dnsChallenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	renewed, err := certificate.GetCertificate(certificate.VaultCertLocation(domains[0]), vaultClient)
+	testutil.Ok(t, err)
+	testutil.Assert(t, renewed.SerialNumber.Cmp(cert.SerialNumber) != 0, "certificate should be replaced")
+}
+
+func TestCertificateRevocation(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		tcaseName  string
+		domain     string
+		reason     uint
+		useCertKey bool
+	}{
+		{
+			tcaseName:  "revocation signed with account key",
+			domain:     "revoke-account-key.com",
+			reason:     4,
+			useCertKey: false,
+		},
+		{
+			tcaseName:  "revocation signed with certificate key",
+			domain:     "revoke-certificate-key.com",
+			reason:     1,
+			useCertKey: true,
+		},
+	} {
+		t.Run(tcase.tcaseName, func(t *testing.T) {
+			err := certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+				Domains:   []string{tcase.domain},
+				KeyType:   certcrypto.RSA2048,
+				Challenge: dnsChallenge,
+			}, logrus.NewEntry(logger))
+			testutil.Ok(t, err)
+
+			err = certificate.RevokeCertificate(acmeClient, vaultClient, certificate.VaultCertLocation(tcase.domain),
+				tcase.reason, tcase.useCertKey)
+			testutil.Ok(t, err)
+
+			// Revoked certificate is reported as missing, so it is reissued on the next run
+			cert, err := certificate.GetCertificate(certificate.VaultCertLocation(tcase.domain), vaultClient)
+			testutil.Ok(t, err)
+			testutil.Assert(t, cert == nil, "revoked certificate should not be returned")
+		})
+	}
+}
+
+func TestAccountKeyRollover(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	oldKey, err := vaultClient.KVRead(accountPath + "key")
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, acmeClient.RolloverKey(vaultClient))
+
+	newKey, err := vaultClient.KVRead(accountPath + "key")
+	testutil.Ok(t, err)
+	testutil.Assert(t, oldKey["pem"] != newKey["pem"], "account key should be replaced")
+
+	pendingKey, err := vaultClient.KVRead(accountPath + "key_rollover")
+	testutil.Ok(t, err)
+	testutil.Assert(t, pendingKey == nil, "pending key should be removed")
+
+	// Client signs requests with the new key after rollover
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   []string{"rollover.com"},
+		KeyType:   certcrypto.RSA2048,
+		Challenge: dnsChallenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	// Registration is found by the new key without reregistering
+	_, err = acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, false, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	// Rollover interrupted after CA accepted the new key is completed on client setup
+	testutil.Ok(t, vaultClient.KVWrite(accountPath+"key_rollover", map[string]string{"pem": newKey["pem"].(string)}))
+	testutil.Ok(t, vaultClient.KVWrite(accountPath+"key", map[string]string{"pem": oldKey["pem"].(string)}))
+
+	_, err = acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, false, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	recoveredKey, err := vaultClient.KVRead(accountPath + "key")
+	testutil.Ok(t, err)
+	testutil.Equals(t, newKey["pem"], recoveredKey["pem"])
+}
+
+func TestAccountContactUpdate(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	// Separate storage path, so that the account of this test is the only one stored for the CA
+	vaultClient, err := vault.NewVaultClient("", "", "dev", "/secret/data/integration_test_contact/", logger)
+	testutil.Ok(t, err)
+
+	oldEmail, newEmail := "old@test.com", "new@test.com"
+	oldPath, err := acme.AccountPath(acmeURL, oldEmail)
+	testutil.Ok(t, err)
+	newPath, err := acme.AccountPath(acmeURL, newEmail)
+	testutil.Ok(t, err)
+	for _, path := range []string{oldPath, newPath} {
+		testutil.Ok(t, vaultClient.KVDelete(path+"account"))
+		testutil.Ok(t, vaultClient.KVDelete(path+"key"))
 	}
+
+	_, err = acme.NewClient(oldEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+	registered := readAccount(t, vaultClient, oldPath)
+
+	// ACME_ACCOUNT_EMAIL is changed, re-registering is disabled so that a new account would fail the setup
+	_, err = acme.NewClient(newEmail, acmeURL, acme.ExternalAccountBinding{}, false, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	updated := readAccount(t, vaultClient, newPath)
+	testutil.Equals(t, registered.Registration.URI, updated.Registration.URI)
+	testutil.Equals(t, newEmail, updated.Email)
+	testutil.Equals(t, []string{"mailto:" + newEmail}, updated.Registration.Body.Contact)
+
+	previous, err := vaultClient.KVRead(oldPath + "account")
+	testutil.Ok(t, err)
+	testutil.Assert(t, previous == nil, "account should be moved from %s", oldPath)
+}
+
+// readAccount reads account stored at path
+func readAccount(t *testing.T, vaultClient *vault.VaultClient, path string) *acme.User {
+	account, err := vaultClient.KVRead(path + "account")
+	testutil.Ok(t, err)
+	testutil.Assert(t, account != nil, "account should be stored at %s", path)
+
+	var acc *acme.User
+	testutil.Ok(t, json.Unmarshal([]byte(account["account"].(string)), &acc))
+
+	return acc
+}
+
+func TestAccountDeactivation(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	email := "deactivate@test.com"
+	path, err := acme.AccountPath(acmeURL, email)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(email, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, acmeClient.Deactivate(vaultClient))
+
+	account, err := vaultClient.KVRead(path + "account")
+	testutil.Ok(t, err)
+	testutil.Assert(t, account == nil, "deactivated account should be removed from vault")
+
+	// A new account is registered on the next run
+	_, err = acme.NewClient(email, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+}
+
+func TestCertificateChains(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	// Pebble is configured to offer alternate chains in docker-compose.yml
+	domain := "chains.com"
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:              []string{domain},
+		KeyType:              certcrypto.RSA2048,
+		StoreAlternateChains: true,
+		Challenge:            dnsChallenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	secrets, err := vaultClient.KVRead("certificates/" + domain)
+	testutil.Ok(t, err)
+	_, ok := secrets["alternate_chain_1"].(string)
+	testutil.Assert(t, ok, "alternate chain should be stored")
+	preferredChain, ok := secrets["alternate_chain_1_issuer"].(string)
+	testutil.Assert(t, ok, "alternate chain issuer should be stored")
+
+	// Chain that was alternate becomes the main one when it is preferred
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:        []string{domain},
+		KeyType:        certcrypto.RSA2048,
+		PreferredChain: preferredChain,
+		Challenge:      dnsChallenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	secrets, err = vaultClient.KVRead("certificates/" + domain)
+	testutil.Ok(t, err)
+	chain, err := certcrypto.ParsePEMBundle([]byte(secrets["certificate"].(string)))
+	testutil.Ok(t, err)
+	testutil.Equals(t, preferredChain, chain[len(chain)-1].Issuer.CommonName)
+	_, ok = secrets["alternate_chain_1"]
+	testutil.Assert(t, !ok, "alternate chains should not be stored")
+}
+
+func TestCertificateVaultPath(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   []string{"custompath.com", "www.custompath.com"},
+		VaultPath: "custom/custompath",
+		KeyType:   certcrypto.RSA2048,
+		Challenge: dnsChallenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	cert, err := certificate.GetCertificate("custom/custompath", vaultClient)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"custompath.com", "www.custompath.com"}, cert.DNSNames)
+
+	cert, err = certificate.GetCertificate(certificate.VaultCertLocation("custompath.com"), vaultClient)
+	testutil.Ok(t, err)
+	testutil.Assert(t, cert == nil, "certificate should not be stored in the default location")
+}
+
+func TestDNSProviderZones(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	// Default provider is not usable, challenges are solved only by providers of the zones
+	challenge := certificate.Challenge{
+		Type:         certificate.ChallengeDNS01,
+		DNSAddresses: []string{"challtestsrv:8053"},
+		DNSProvider:  certificate.DNSProvider{Provider: "exec", Settings: map[string]string{"EXEC_PATH": "/bin/false"}},
+		DNSProviders: []certificate.DNSProvider{
+			{
+				Provider: "exec",
+				Zones:    []string{"zone-a.com"},
+				Settings: map[string]string{"EXEC_PATH": "../fixtures/update-dns.sh"},
+			},
+			{
+				Provider: "exec",
+				Zones:    []string{"zone-b.com"},
+				Settings: map[string]string{"EXEC_PATH": "../fixtures/update-dns.sh"},
+			},
+		},
+	}
+
+	// Pebble sorts certificate domains
+	domains := []string{"zone-a.com", "*.zone-b.com", "www.zone-a.com"}
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   domains,
+		KeyType:   certcrypto.RSA2048,
+		Challenge: challenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	cert, err := certificate.GetCertificate(certificate.VaultCertLocation(domains[0]), vaultClient)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"*.zone-b.com", "www.zone-a.com", "zone-a.com"}, cert.DNSNames)
+
+	// Domains outside the zones are solved by the default provider
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   []string{"zone-a.com", "other-zone.com"},
+		KeyType:   certcrypto.RSA2048,
+		Challenge: challenge,
+	}, logrus.NewEntry(logger))
+	testutil.NotOk(t, err)
+}
+
+func TestDNSProviderVaultCredentials(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	// Provider must not be configured from process environment
+	os.Unsetenv("EXEC_PATH")
+	defer os.Setenv("EXEC_PATH", "../fixtures/update-dns.sh")
+
+	err = vaultClient.KVWrite("dns/exec", map[string]string{"EXEC_PATH": "../fixtures/update-dns.sh"})
+	testutil.Ok(t, err)
+
+	request := certificate.Request{
+		Domains: []string{"vaultcredentials.com"},
+		KeyType: certcrypto.RSA2048,
+		Challenge: certificate.Challenge{
+			Type:         certificate.ChallengeDNS01,
+			DNSAddresses: []string{"challtestsrv:8053"},
+			DNSProvider:  certificate.DNSProvider{Provider: "exec", VaultPath: "dns/exec"},
+		},
+	}
+	testutil.Ok(t, certificate.ObtainCertificate(acmeClient, vaultClient, request, logrus.NewEntry(logger)))
+
+	// Rotated credentials are used on the next run
+	err = vaultClient.KVWrite("dns/exec", map[string]string{"EXEC_PATH": "/bin/false"})
+	testutil.Ok(t, err)
+	testutil.NotOk(t, certificate.ObtainCertificate(acmeClient, vaultClient, request, logrus.NewEntry(logger)))
+}
+
+func TestHTTP01Challenge(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	// Pebble validates http-01 challenges on port 5002
+	webroot := t.TempDir()
+	server := &http.Server{Addr: ":5002", Handler: http.FileServer(http.Dir(webroot))}
+
+	for _, tcase := range []struct {
+		domain    string
+		challenge certificate.Challenge
+		webroot   bool
+	}{
+		{
+			domain: "http01.com",
+			challenge: certificate.Challenge{
+				Type:        certificate.ChallengeHTTP01,
+				HTTPAddress: ":5002",
+			},
+		},
+		{
+			domain: "webroot.http01.com",
+			challenge: certificate.Challenge{
+				Type:        certificate.ChallengeHTTP01,
+				HTTPWebroot: webroot,
+			},
+			webroot: true,
+		},
+	} {
+		t.Run(tcase.domain, func(t *testing.T) {
+			addARecord(t, tcase.domain)
+
+			if tcase.webroot {
+				listener, err := net.Listen("tcp", server.Addr)
+				testutil.Ok(t, err)
+				go server.Serve(listener) //nolint:errcheck
+				defer server.Close()
+			}
+
+			err := certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+				Domains:   []string{tcase.domain},
+				KeyType:   certcrypto.RSA2048,
+				Challenge: tcase.challenge,
+			}, logrus.NewEntry(logger))
+			testutil.Ok(t, err)
+
+			cert, err := certificate.GetCertificate(certificate.VaultCertLocation(tcase.domain), vaultClient)
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{tcase.domain}, cert.DNSNames)
+		})
+	}
+}
+
+func TestTLSALPN01Challenge(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	domain := "tlsalpn01.com"
+	addARecord(t, domain)
+
+	// Pebble validates tls-alpn-01 challenges on port 5001
+	challenge := certificate.Challenge{
+		Type:           certificate.ChallengeTLSALPN01,
+		TLSALPNAddress: ":5001",
+	}
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   []string{domain},
+		KeyType:   certcrypto.RSA2048,
+		Challenge: challenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	cert, err := certificate.GetCertificate(certificate.VaultCertLocation(domain), vaultClient)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{domain}, cert.DNSNames)
+}
+
+// addARecord points host to this container in challtestsrv, so that the CA
+// is able to reach challenge servers started by tests
+func addARecord(t *testing.T, host string) {
+	hostname, err := os.Hostname()
+	testutil.Ok(t, err)
+	addrs, err := net.LookupHost(hostname)
+	testutil.Ok(t, err)
+	testutil.Assert(t, len(addrs) > 0, "container address should be resolvable")
+
+	body := fmt.Sprintf(`{"host":"%s", "addresses": ["%s"]}`, host, addrs[0])
+	resp, err := http.Post("http://challtestsrv:8055/add-a", "application/json", strings.NewReader(body))
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
 }
 
 func deleteAccountFromVault(t *testing.T, cl *api.Client) {
 	t.Log("Deleting account from Vault")
-	_, err := cl.Logical().Delete(vaultKVPath + "account")
+	_, err := cl.Logical().Delete(vaultKVPath + accountPath + "account")
 	testutil.Ok(t, err)
 }
 
 func deleteKeyFromVault(t *testing.T, cl *api.Client) {
 	t.Log("Deleting key from Vault")
-	_, err := cl.Logical().Delete(vaultKVPath + "key")
+	_, err := cl.Logical().Delete(vaultKVPath + accountPath + "key")
+	testutil.Ok(t, err)
+}
+
+func TestDNSResolvers(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	// Unreachable resolver is skipped in favor of the next one
+	challenge := dnsChallenge
+	challenge.DNSAddresses = []string{"127.0.0.1:1", "challtestsrv:8053"}
+	challenge.DNSTiming = certificate.DNSTiming{
+		TTL:                60,
+		PropagationTimeout: 2 * time.Minute,
+		PollingInterval:    time.Second,
+	}
+
+	domain := "resolvers.com"
+	err = certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+		Domains:   []string{domain},
+		KeyType:   certcrypto.RSA2048,
+		Challenge: challenge,
+	}, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+
+	cert, err := certificate.GetCertificate(certificate.VaultCertLocation(domain), vaultClient)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{domain}, cert.DNSNames)
+}
+
+func TestVaultAuthMethods(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	rootClient, err := api.NewClient(api.DefaultConfig())
+	testutil.Ok(t, err)
+	rootClient.SetToken(vaultDevToken)
+
+	testutil.Ok(t, rootClient.Sys().PutPolicy("certificator",
+		`path "secret/data/integration_test/*" { capabilities = ["create", "read", "update", "delete"] }`))
+
+	auths, err := rootClient.Sys().ListAuth()
+	testutil.Ok(t, err)
+	for mount, method := range map[string]string{"userpass": "userpass", "approle-certificator": "approle"} {
+		if _, ok := auths[mount+"/"]; !ok {
+			testutil.Ok(t, rootClient.Sys().EnableAuthWithOptions(mount, &api.EnableAuthOptions{Type: method}))
+		}
+	}
+
+	_, err = rootClient.Logical().Write("auth/userpass/users/certificator",
+		map[string]interface{}{"password": "password", "token_policies": "certificator"})
+	testutil.Ok(t, err)
+
+	_, err = rootClient.Logical().Write("auth/approle-certificator/role/certificator",
+		map[string]interface{}{"token_policies": "certificator"})
+	testutil.Ok(t, err)
+	roleID, err := rootClient.Logical().Read("auth/approle-certificator/role/certificator/role-id")
+	testutil.Ok(t, err)
+	secretID, err := rootClient.Logical().Write("auth/approle-certificator/role/certificator/secret-id", nil)
+	testutil.Ok(t, err)
+
+	token, err := rootClient.Auth().Token().Create(&api.TokenCreateRequest{Policies: []string{"certificator"}})
+	testutil.Ok(t, err)
+	tokenFile := t.TempDir() + "/token"
+	testutil.Ok(t, os.WriteFile(tokenFile, []byte(token.Auth.ClientToken+"\n"), 0600))
+
+	for _, tcase := range []struct {
+		name string
+		auth vault.Auth
+	}{
+		{name: "token", auth: vault.Auth{Method: vault.AuthToken, Token: token.Auth.ClientToken}},
+		{name: "token file", auth: vault.Auth{Method: vault.AuthTokenFile, TokenFile: tokenFile}},
+		{name: "userpass", auth: vault.Auth{Method: vault.AuthUserpass, Username: "certificator", Password: "password"}},
+		{
+			name: "approle",
+			auth: vault.Auth{
+				Method:   vault.AuthAppRole,
+				Mount:    "approle-certificator",
+				RoleID:   roleID.Data["role_id"].(string),
+				SecretID: secretID.Data["secret_id"].(string),
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			vaultClient, err := vault.NewVaultClientWithAuth(tcase.auth, vaultKVPath, logger)
+			testutil.Ok(t, err)
+
+			path := "auth/" + strings.ReplaceAll(tcase.name, " ", "_")
+			testutil.Ok(t, vaultClient.KVWrite(path, map[string]string{"method": tcase.name}))
+			secrets, err := vaultClient.KVRead(path)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.name, secrets["method"])
+		})
+	}
+
+	_, err = vault.NewVaultClientWithAuth(vault.Auth{Method: vault.AuthUserpass, Username: "certificator",
+		Password: "wrong"}, vaultKVPath, logger)
+	testutil.NotOk(t, err)
+}
+
+func TestVaultKVVersions(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	rootClient, err := api.NewClient(api.DefaultConfig())
+	testutil.Ok(t, err)
+	rootClient.SetToken(vaultDevToken)
+
+	mounts, err := rootClient.Sys().ListMounts()
 	testutil.Ok(t, err)
+	if _, ok := mounts["kv1/"]; !ok {
+		testutil.Ok(t, rootClient.Sys().Mount("kv1", &api.MountInput{Type: "kv", Options: map[string]string{"version": "1"}}))
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		kvPath   string
+		dataPath string
+	}{
+		{name: "kv v1", kvPath: "kv1/integration_test/", dataPath: "kv1/integration_test/kv_version"},
+		{name: "kv v2", kvPath: "secret/integration_test/", dataPath: "secret/data/integration_test/kv_version"},
+		{name: "legacy kv v2 path", kvPath: vaultKVPath, dataPath: "secret/data/integration_test/kv_version"},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			vaultClient, err := vault.NewVaultClient("", "", "dev", tcase.kvPath, logger)
+			testutil.Ok(t, err)
+			defer vaultClient.Close()
+
+			testutil.Ok(t, vaultClient.KVWrite("kv_version", map[string]string{"name": tcase.name}))
+			secrets, err := vaultClient.KVRead("kv_version")
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.name, secrets["name"])
+
+			secret, err := rootClient.Logical().Read(tcase.dataPath)
+			testutil.Ok(t, err)
+			testutil.Assert(t, secret != nil, "secret should be stored at %s", tcase.dataPath)
+
+			testutil.Ok(t, vaultClient.KVDelete("kv_version"))
+			secrets, err = vaultClient.KVRead("kv_version")
+			testutil.Ok(t, err)
+			testutil.Assert(t, secrets == nil, "deleted secret should not be read")
+		})
+	}
+}
+
+func TestCertificateVersions(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	vaultClient, err := vault.NewVaultClient("", "", "dev", vaultKVPath, logger)
+	testutil.Ok(t, err)
+
+	acmeClient, err := acme.NewClient(acmeEmail, acmeURL, acme.ExternalAccountBinding{}, true, vaultClient, logger)
+	testutil.Ok(t, err)
+
+	domains := []string{"versions.com"}
+	location := certificate.VaultCertLocation(domains[0])
+	obtain := func(version int) error {
+		return certificate.ObtainCertificate(acmeClient, vaultClient, certificate.Request{
+			Domains:      domains,
+			KeyType:      certcrypto.RSA2048,
+			VaultVersion: &version,
+			Challenge:    dnsChallenge,
+		}, logrus.NewEntry(logger))
+	}
+
+	_, version, err := certificate.GetCertificateVersion(location, vaultClient)
+	testutil.Ok(t, err)
+	testutil.Ok(t, obtain(version))
+	first, version, err := certificate.GetCertificateVersion(location, vaultClient)
+	testutil.Ok(t, err)
+	testutil.Ok(t, obtain(version))
+	second, _, err := certificate.GetCertificateVersion(location, vaultClient)
+	testutil.Ok(t, err)
+
+	// Certificate obtained based on a stale version is not stored
+	err = obtain(version)
+	testutil.Assert(t, errors.Is(err, vault.ErrVersionConflict), "stale version should conflict, got %v", err)
+	current, _, err := certificate.GetCertificateVersion(location, vaultClient)
+	testutil.Ok(t, err)
+	testutil.Equals(t, second.SerialNumber, current.SerialNumber)
+
+	// The previous certificate is restored
+	restored, err := certificate.RollbackCertificate(location, 0, domains, vaultClient, logrus.NewEntry(logger))
+	testutil.Ok(t, err)
+	testutil.Equals(t, version, restored)
+	current, _, err = certificate.GetCertificateVersion(location, vaultClient)
+	testutil.Ok(t, err)
+	testutil.Equals(t, first.SerialNumber, current.SerialNumber)
+
+	// Certificate of other domains is not restored
+	_, err = certificate.RollbackCertificate(location, version+1, []string{"other.com"}, vaultClient,
+		logrus.NewEntry(logger))
+	testutil.NotOk(t, err)
 }